@@ -1,3 +1,67 @@
 // export const baseUrl = "http://localhost:8000/api/v1";
 export const baseUrl = "https://backend.timemachine.mescreators.com:443/api/v1";
 
+// Sends an authorized request, renewing the access token once if the server reports it as expired
+export async function fetchWithRefresh(url, options) {
+  const rawResponse = await fetch(url, options);
+
+  if(rawResponse.status !== 401) {
+    return rawResponse;
+  }
+
+  let storage = window.localStorage;
+  let jwt = storage.getItem("jwt");
+
+  // Another request may already have renewed the token
+  if(options.headers['Authorization'] === `Bearer ${jwt}`) {
+    const refreshResponse = await fetch(`${baseUrl}/token/refresh`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify({
+        refresh_token: storage.getItem("refresh_token")
+      })
+    });
+
+    if(!refreshResponse.ok) {
+      return rawResponse;
+    }
+
+    let token = await refreshResponse.json();
+    storage.setItem("jwt", token.jwt);
+    storage.setItem("refresh_token", token.refresh_token);
+    jwt = token.jwt;
+  }
+
+  options.headers['Authorization'] = `Bearer ${jwt}`;
+  return await fetch(url, options);
+}
+
+// Reads one page of a paginated listing, the next page is read by passing the next_cursor of this one
+export async function fetchPage(url, jwt, params = {}, cursor = null) {
+  let query = new URLSearchParams();
+  for (const [key, value] of Object.entries(params)) {
+    for (const v of [].concat(value)) {
+      query.append(key, v);
+    }
+  }
+  if(cursor != null) {
+    query.append('cursor', cursor);
+  }
+
+  const rawResponse = await fetchWithRefresh(`${url}?${query}`, {
+    method: 'GET',
+    headers: {
+      'Accept': 'application/json',
+      'Authorization': `Bearer ${jwt}`
+    }
+  });
+
+  if(!rawResponse.ok) {
+    throw Error(rawResponse.statusText);
+  }
+
+  // Holds the items, the total across every page and the next_cursor, which the last page leaves out
+  return await rawResponse.json();
+}
@@ -23,22 +23,20 @@ export async function loginUser(username, password) {
     throw rawResponse.status;
   }
 
-  // Return the json which is a JWT and the permission
+  // Return the json which is a JWT, a refresh token and the permission
   return await rawResponse.json();
 }
 
-export async function registerUser(username, password, type, amb, depot, platoon, section, man, name) {
+export async function registerUser(invite, username, password, man, firstName, lastName, rank) {
   // Create json
   let req = JSON.stringify({
+    invite,
     username,
     password,
-    type,
-    amb,
-    depot,
-    platoon,
-    section,
     man,
-    name
+    first_name: firstName,
+    last_name: lastName,
+    rank
   });
   
   const rawResponse = await fetch(`${baseUrl}/register`, {
@@ -50,9 +48,30 @@ export async function registerUser(username, password, type, amb, depot, platoon
   });
 
   if(!rawResponse.ok) {
-    throw Error(response.statusText);
+    throw Error(rawResponse.statusText);
   }
 
-  // Return the text which is a JWT
-  return await rawResponse.text() 
+  // Return the json which is a JWT, a refresh token and the permission
+  return await rawResponse.json();
+}
+
+export async function logoutUser(refreshToken) {
+  // Create json
+  let req = JSON.stringify({
+    refresh_token: refreshToken
+  });
+
+  const rawResponse = await fetch(`${baseUrl}/logout`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json'
+    },
+    body: req
+  });
+
+  if(!rawResponse.ok) {
+    throw Error(rawResponse.statusText);
+  }
+
+  return await rawResponse.text();
 }
@@ -1,31 +1,22 @@
-import { baseUrl } from './HttpService.js';
+import { baseUrl, fetchWithRefresh, fetchPage } from './HttpService.js';
 
-export async function getTasks(jwt) {
-  const rawResponse = await fetch(`${baseUrl}/tasks`, {
-    method: 'GET',
-    headers: {
-      'Accept': 'application/json',
-      'Authorization': `Bearer ${jwt}`
-    }
-  });
-
-  if(!rawResponse.ok) {
-    throw Error(rawResponse.statusText);
-  }
-
-  // Return the User object
-  let tasks = await rawResponse.json();
-  return tasks;
+export async function getTasks(jwt, filters = {}, cursor = null) {
+  // Optional assigned_to, priority, category, tag, q and sort query parameters
+  return await fetchPage(`${baseUrl}/tasks`, jwt, filters, cursor);
 }
 
-export async function createTask(jwt, name, assignedTo) {
+export async function createTask(jwt, name, assignedTo, dueAt = null, priority = 'normal', category = '', tags = []) {
   // Create json
   let req = JSON.stringify({
     name,
-    assigned_to: assignedTo
+    assigned_to: assignedTo,
+    due_at: dueAt,
+    priority,
+    category,
+    tags
   }); 
   
-  const rawResponse = await fetch(`${baseUrl}/tasks`, {
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/tasks`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -42,18 +33,11 @@ export async function createTask(jwt, name, assignedTo) {
 }
 
 export async function deleteTask(jwt, id) {
-  // Create json
-  let req = JSON.stringify({
-    id
-  }); 
-  
-  const rawResponse = await fetch(`${baseUrl}/tasks`, {
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/tasks/${id}`, {
     method: 'DELETE',
     headers: {
-      'Content-Type': 'application/json',
       'Authorization': `Bearer ${jwt}`
-    },
-    body: req
+    }
   });
 
   if(!rawResponse.ok) {
@@ -63,20 +47,78 @@ export async function deleteTask(jwt, id) {
   return await rawResponse.text()
 }
 
-export async function toggleVerifyTask(jwt, task, userid) {
+// Status changes only send the status and are refused with 412 Precondition Failed
+// when the task has been changed since it was loaded
+async function patchTaskStatus(jwt, task, changes) {
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/tasks/${task.id}`, {
+    method: 'PATCH',
+    headers: {
+      'Content-Type': 'application/json',
+      'Authorization': `Bearer ${jwt}`,
+      'If-Match': `"${task.version}"`
+    },
+    body: JSON.stringify(changes)
+  });
+
+  if(!rawResponse.ok) {
+    throw Error(rawResponse.statusText);
+  }
+
+  return await rawResponse.json()
+}
+
+export async function verifyTask(jwt, task) {
+  return await patchTaskStatus(jwt, task, {
+    status: 'verified'
+  });
+}
+
+export async function rejectTask(jwt, task, reason) {
+  return await patchTaskStatus(jwt, task, {
+    status: 'rejected',
+    rejection_reason: reason
+  });
+}
+
+// Tasks that are assigned or were rejected are started before they can be submitted
+export async function submitTask(jwt, task) {
+  if (task.status !== 'in_progress') {
+    task = await patchTaskStatus(jwt, task, {
+      status: 'in_progress'
+    });
+  }
+
+  return await patchTaskStatus(jwt, task, {
+    status: 'submitted'
+  });
+}
+
+export async function getComments(jwt, taskId) {
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/tasks/${taskId}/comments`, {
+    method: 'GET',
+    headers: {
+      'Accept': 'application/json',
+      'Authorization': `Bearer ${jwt}`
+    }
+  });
+
+  if(!rawResponse.ok) {
+    throw Error(rawResponse.statusText);
+  }
+
+  // Return the list of comments, oldest first
+  let comments = await rawResponse.json();
+  return comments;
+}
+
+export async function createComment(jwt, taskId, body) {
   // Create json
   let req = JSON.stringify({
-    id: task.id,
-    name: task.name,
-    assigned_to: task.assigned_to,
-    assigned_by: task.assigned_by,
-    completed: task.completed,
-    verified: !task.verified,
-    verified_by: userid
-  }); 
+    body
+  });
 
-  const rawResponse = await fetch(`${baseUrl}/tasks`, {
-    method: 'PUT',
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/tasks/${taskId}/comments`, {
+    method: 'POST',
     headers: {
       'Content-Type': 'application/json',
       'Authorization': `Bearer ${jwt}`
@@ -88,33 +130,25 @@ export async function toggleVerifyTask(jwt, task, userid) {
     throw Error(rawResponse.statusText);
   }
 
-  return await rawResponse.text()
+  return await rawResponse.json();
 }
 
-export async function toggleCompletedTask(jwt, task) {
-  // Create json
-  let req = JSON.stringify({
-    id: task.id,
-    name: task.name,
-    assigned_to: task.assigned_to,
-    assigned_by: task.assigned_by,
-    completed: !task.completed,
-    verified: task.verified,
-    verfied_by: task.verified_by
-  }); 
+export async function uploadAttachment(jwt, taskId, file) {
+  // The browser sets the multipart boundary itself
+  let form = new FormData();
+  form.append("file", file);
 
-  const rawResponse = await fetch(`${baseUrl}/tasks`, {
-    method: 'PUT',
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/tasks/${taskId}/attachments`, {
+    method: 'POST',
     headers: {
-      'Content-Type': 'application/json',
       'Authorization': `Bearer ${jwt}`
     },
-    body: req
+    body: form
   });
 
   if(!rawResponse.ok) {
     throw Error(rawResponse.statusText);
   }
 
-  return await rawResponse.text()
+  return await rawResponse.json();
 }
@@ -1,7 +1,7 @@
-import { baseUrl } from './HttpService.js';
+import { baseUrl, fetchWithRefresh, fetchPage } from './HttpService.js';
 
 export async function getSelf(jwt) {
-  const rawResponse = await fetch(`${baseUrl}/users/self`, {
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/users/self`, {
     method: 'GET',
     headers: {
       'Accept': 'application/json',
@@ -19,7 +19,7 @@ export async function getSelf(jwt) {
 }
 
 export async function getUserById(jwt, uid) {
-  const rawResponse = await fetch(`${baseUrl}/users/${uid}`, {
+  const rawResponse = await fetchWithRefresh(`${baseUrl}/users/${uid}`, {
     method: 'GET',
     headers: {
       'Accept': 'application/json',
@@ -36,20 +36,7 @@ export async function getUserById(jwt, uid) {
   return user;
 }
 
-export async function getAllUsers(jwt) {
-  const rawResponse = await fetch(`${baseUrl}/users`, {
-    method: 'GET',
-    headers: {
-      'Accept': 'application/json',
-      'Authorization': `Bearer ${jwt}`
-    }
-  });
-
-  if(!rawResponse.ok) {
-    throw Error(rawResponse.statusText);
-  }
-
-  // Return the User object
-  let users = await rawResponse.json();
-  return users;
+export async function getAllUsers(jwt, filters = {}, cursor = null) {
+  // Optional q, sort and include_inactive query parameters
+  return await fetchPage(`${baseUrl}/users`, jwt, filters, cursor);
 }
@@ -0,0 +1,199 @@
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shorthands accepted in place of a full expression
+var presets = map[string]string{
+	"daily":    "0 0 * * *",
+	"@daily":   "0 0 * * *",
+	"weekly":   "0 0 * * 1",
+	"@weekly":  "0 0 * * 1",
+	"monthly":  "0 0 1 * *",
+	"@monthly": "0 0 1 * *",
+}
+
+// Schedule is a parsed five field cron expression (minute hour day-of-month month day-of-week)
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Like standard cron, a day matches on either field when both day fields are restricted.
+	// A field starting with *, e.g. */2, is not restricted in this sense.
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	min, max int
+}
+
+// Sunday can be written as both 0 and 7 in the day-of-week field
+var fieldBounds = []bounds{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func Parse(rule string) (Schedule, error) {
+	var schedule Schedule
+
+	rule = strings.TrimSpace(rule)
+	if preset, ok := presets[strings.ToLower(rule)]; ok {
+		rule = preset
+	}
+
+	fields := strings.Fields(rule)
+	if len(fields) != 5 {
+		return schedule, errors.New("A schedule needs 5 fields: minute hour day-of-month month day-of-week")
+	}
+
+	bits := make([]uint64, 5)
+	for i, field := range fields {
+		b, err := parseField(field, fieldBounds[i])
+		if err != nil {
+			return schedule, err
+		}
+		bits[i] = b
+	}
+
+	schedule.minute, schedule.hour, schedule.dom, schedule.month = bits[0], bits[1], bits[2], bits[3]
+	schedule.dow = bits[4]&0x7f | bits[4]>>7
+	schedule.domStar = strings.HasPrefix(fields[2], "*")
+	schedule.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+// Parses a comma separated list of values, ranges and steps into a bit set
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("Invalid step in %q", field)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		start, end := b.min, b.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			v, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("Invalid value in %q", field)
+			}
+			start, end = v, v
+
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid value in %q", field)
+				}
+			} else if step > 1 {
+				end = b.max
+			}
+		}
+
+		if start < b.min || end > b.max || start > end {
+			return 0, fmt.Errorf("Value out of range in %q", field)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// Next returns the first time matching the schedule strictly after the given time, in its location.
+// A zero time is returned when nothing matches within the next five years, e.g. for the 30th of February.
+// Times that happen twice when the clocks go back run once, at the first of them, and times skipped when
+// the clocks go forward run as they are skipped.
+func (s Schedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+
+	// The wall clock of the location is walked as if it were UTC, which has no shifts to skip or repeat
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute()+1, 0, 0, time.UTC)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		// The first of two matching times may already be behind the given one
+		if next := resolve(t, loc); next.After(after) {
+			return next
+		}
+
+		t = t.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
+
+// Finds the time the wall clock of the location reads as wall does in UTC. A reading that happens twice
+// resolves to the first of them, and a reading that is skipped to the end of the gap.
+func resolve(wall time.Time, loc *time.Location) time.Time {
+	// The offsets in use a day before and after cover any single shift of the clocks
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+
+	first := wall.Add(-time.Duration(before) * time.Second).In(loc)
+	second := wall.Add(-time.Duration(after) * time.Second).In(loc)
+	if second.Before(first) {
+		first, second = second, first
+	}
+
+	for _, t := range []time.Time{first, second} {
+		if time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Equal(wall) {
+			return t
+		}
+	}
+
+	// Neither offset reads as wall, the clocks went forward between the two times. Offsets only change
+	// on whole seconds, so the shift is found to the second.
+	_, offset := first.Zone()
+	for second.Sub(first) > time.Second {
+		middle := first.Add(second.Sub(first) / 2)
+		if _, o := middle.Zone(); o == offset {
+			first = middle
+		} else {
+			second = middle
+		}
+	}
+
+	return second.Truncate(time.Second)
+}
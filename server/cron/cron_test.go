@@ -0,0 +1,219 @@
+package cron
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func bits(values ...int) uint64 {
+	var b uint64
+	for _, v := range values {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func span(min, max, step int) uint64 {
+	var b uint64
+	for v := min; v <= max; v += step {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	every := Schedule{minute: span(0, 59, 1), hour: span(0, 23, 1), dom: span(1, 31, 1), month: span(1, 12, 1), dow: span(0, 6, 1), domStar: true, dowStar: true}
+	midnight := every
+	midnight.minute, midnight.hour = bits(0), bits(0)
+
+	tests := []struct {
+		rule string
+		want func(s *Schedule)
+	}{
+		{"* * * * *", func(s *Schedule) {}},
+		{"  * * * * *  ", func(s *Schedule) {}},
+		{"5 4 * * *", func(s *Schedule) { s.minute, s.hour = bits(5), bits(4) }},
+		{"59 23 31 12 6", func(s *Schedule) {
+			s.minute, s.hour, s.dom, s.month, s.dow = bits(59), bits(23), bits(31), bits(12), bits(6)
+			s.domStar, s.dowStar = false, false
+		}},
+		// Ranges, steps and lists
+		{"0-4 * * * *", func(s *Schedule) { s.minute = span(0, 4, 1) }},
+		{"*/15 * * * *", func(s *Schedule) { s.minute = bits(0, 15, 30, 45) }},
+		{"0-20/10 * * * *", func(s *Schedule) { s.minute = bits(0, 10, 20) }},
+		{"30/10 * * * *", func(s *Schedule) { s.minute = bits(30, 40, 50) }},
+		{"0 */6 * * *", func(s *Schedule) { s.minute, s.hour = bits(0), bits(0, 6, 12, 18) }},
+		{"0 8,12-13,20 * * *", func(s *Schedule) { s.minute, s.hour = bits(0), bits(8, 12, 13, 20) }},
+		{"0 0 1,15 * *", func(s *Schedule) { s.minute, s.hour, s.dom, s.domStar = bits(0), bits(0), bits(1, 15), false }},
+		{"0 0 * 1-3,12 *", func(s *Schedule) { s.minute, s.hour, s.month = bits(0), bits(0), bits(1, 2, 3, 12) }},
+		// Sunday is both 0 and 7
+		{"0 0 * * 0", func(s *Schedule) { s.minute, s.hour, s.dow, s.dowStar = bits(0), bits(0), bits(0), false }},
+		{"0 0 * * 7", func(s *Schedule) { s.minute, s.hour, s.dow, s.dowStar = bits(0), bits(0), bits(0), false }},
+		{"0 0 * * 5-7", func(s *Schedule) { s.minute, s.hour, s.dow, s.dowStar = bits(0), bits(0), bits(0, 5, 6), false }},
+		{"0 0 * * 1-5", func(s *Schedule) { s.minute, s.hour, s.dow, s.dowStar = bits(0), bits(0), span(1, 5, 1), false }},
+		// Fields starting with * are unrestricted for the choice between the day fields
+		{"0 0 */2 * *", func(s *Schedule) { s.minute, s.hour, s.dom = bits(0), bits(0), span(1, 31, 2) }},
+		{"0 0 * * */2", func(s *Schedule) { s.minute, s.hour, s.dow = bits(0), bits(0), bits(0, 2, 4, 6) }},
+		// Presets
+		{"daily", func(s *Schedule) { *s = midnight }},
+		{"@daily", func(s *Schedule) { *s = midnight }},
+		{"Weekly", func(s *Schedule) { *s = midnight; s.dow, s.dowStar = bits(1), false }},
+		{"@monthly", func(s *Schedule) { *s = midnight; s.dom, s.domStar = bits(1), false }},
+	}
+
+	for _, test := range tests {
+		want := every
+		test.want(&want)
+
+		got, err := Parse(test.rule)
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", test.rule, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.rule, got, want)
+		}
+	}
+}
+
+func TestParseRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"hourly",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-1 * * * *",
+		"0-60 * * * *",
+		"*/0 * * * *",
+		"*/-5 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"1-2-3 * * * *",
+		"1,,2 * * * *",
+		"* * * JAN *",
+		"* * * * MON",
+	} {
+		if _, err := Parse(rule); err == nil {
+			t.Errorf("Parse(%q) succeeded", rule)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		rule  string
+		after time.Time
+		want  time.Time
+	}{
+		// Strictly after the given time, whatever its seconds
+		{"* * * * *", utc(2024, 1, 1, 10, 0).Add(30 * time.Second), utc(2024, 1, 1, 10, 1)},
+		{"0 * * * *", utc(2024, 1, 1, 10, 0), utc(2024, 1, 1, 11, 0)},
+		{"*/15 * * * *", utc(2024, 1, 1, 10, 15), utc(2024, 1, 1, 10, 30)},
+		// Rolling over into the next hour, day, month and year
+		{"0 * * * *", utc(2024, 1, 1, 23, 30), utc(2024, 1, 2, 0, 0)},
+		{"30 9 * * *", utc(2024, 1, 1, 10, 0), utc(2024, 1, 2, 9, 30)},
+		{"0 0 * * *", utc(2024, 1, 31, 12, 0), utc(2024, 2, 1, 0, 0)},
+		{"0 0 1 * *", utc(2024, 1, 15, 0, 0), utc(2024, 2, 1, 0, 0)},
+		{"0 0 1 1 *", utc(2024, 3, 1, 0, 0), utc(2025, 1, 1, 0, 0)},
+		{"0 0 * * *", utc(2024, 12, 31, 23, 59), utc(2025, 1, 1, 0, 0)},
+		// Months without the day are skipped
+		{"0 0 31 * *", utc(2024, 4, 1, 0, 0), utc(2024, 5, 31, 0, 0)},
+		{"0 0 30 * *", utc(2024, 2, 1, 0, 0), utc(2024, 3, 30, 0, 0)},
+		{"0 0 29 2 *", utc(2024, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		// Days of the week, Sunday as 0 and 7
+		{"0 12 * * 7", utc(2024, 1, 1, 0, 0), utc(2024, 1, 7, 12, 0)},
+		{"0 12 * * 0", utc(2024, 1, 7, 12, 0), utc(2024, 1, 14, 12, 0)},
+		{"0 9 * * 1-5", utc(2024, 1, 5, 10, 0), utc(2024, 1, 8, 9, 0)},
+		// Either restricted day field matches, the 13th or a Friday
+		{"0 0 13 * 5", utc(2024, 1, 1, 0, 0), utc(2024, 1, 5, 0, 0)},
+		{"0 0 13 * 5", utc(2024, 1, 12, 0, 0), utc(2024, 1, 13, 0, 0)},
+		// A day field starting with * has to match along with the other one, odd days that are Mondays
+		{"0 0 */2 * 1", utc(2024, 1, 1, 0, 0), utc(2024, 1, 15, 0, 0)},
+		{"0 0 13 * */7", utc(2024, 1, 1, 0, 0), utc(2024, 10, 13, 0, 0)},
+		// Dates that never happen
+		{"0 0 30 2 *", utc(2024, 1, 1, 0, 0), time.Time{}},
+		{"0 0 31 2 *", utc(2024, 1, 1, 0, 0), time.Time{}},
+		{"0 0 31 4,6,9,11 *", utc(2024, 1, 1, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := Parse(test.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", test.rule, err)
+		}
+
+		if got := schedule.Next(test.after); !got.Equal(test.want) {
+			t.Errorf("Next(%q) after %s = %s, want %s", test.rule, test.after, got, test.want)
+		}
+	}
+}
+
+// Clocks go forward at 02:00 and back at 03:00 in Berlin, and at 02:00 both ways in New York
+func TestNextAcrossDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Times in UTC, which stay clear of the shifts
+	utc := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		rule  string
+		loc   *time.Location
+		after time.Time
+		want  time.Time
+	}{
+		{"daily run before the gap", "30 1 * * *", berlin, utc(2024, 3, 30, 12, 0), utc(2024, 3, 31, 0, 30)},
+		{"daily run after the gap", "30 3 * * *", berlin, utc(2024, 3, 30, 12, 0), utc(2024, 3, 31, 1, 30)},
+		{"daily run in the gap happens as the clocks go forward", "30 2 * * *", berlin, utc(2024, 3, 30, 12, 0), utc(2024, 3, 31, 1, 0)},
+		{"daily run in the gap is back the next day", "30 2 * * *", berlin, utc(2024, 3, 31, 1, 0), utc(2024, 4, 1, 0, 30)},
+		{"runs within the gap happen once", "*/15 2 * * *", berlin, utc(2024, 3, 31, 0, 59), utc(2024, 3, 31, 1, 0)},
+		{"runs after the gap go on", "*/15 2,3 * * *", berlin, utc(2024, 3, 31, 1, 0), utc(2024, 3, 31, 1, 15)},
+		{"hourly runs skip the missing hour", "0 * * * *", berlin, utc(2024, 3, 31, 0, 0), utc(2024, 3, 31, 1, 0)},
+		{"daily run in the gap in New York", "30 2 * * *", newYork, utc(2024, 3, 9, 12, 0), utc(2024, 3, 10, 7, 0)},
+
+		{"daily run in the overlap happens at the first of the two", "30 2 * * *", berlin, utc(2024, 10, 26, 12, 0), utc(2024, 10, 27, 0, 30)},
+		{"daily run in the overlap happens once", "30 2 * * *", berlin, utc(2024, 10, 27, 0, 30), utc(2024, 10, 28, 1, 30)},
+		{"daily run in the overlap is not repeated in the second pass", "30 2 * * *", berlin, utc(2024, 10, 27, 1, 10), utc(2024, 10, 28, 1, 30)},
+		{"daily run after the overlap", "30 3 * * *", berlin, utc(2024, 10, 26, 12, 0), utc(2024, 10, 27, 2, 30)},
+		{"daily run in the overlap in New York", "30 1 * * *", newYork, utc(2024, 11, 2, 12, 0), utc(2024, 11, 3, 5, 30)},
+		{"daily run in the overlap in New York happens once", "30 1 * * *", newYork, utc(2024, 11, 3, 5, 30), utc(2024, 11, 4, 6, 30)},
+	}
+
+	for _, test := range tests {
+		schedule, err := Parse(test.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", test.rule, err)
+		}
+
+		got := schedule.Next(test.after.In(test.loc))
+		if !got.Equal(test.want) {
+			t.Errorf("%s: Next(%q) after %s = %s, want %s", test.name, test.rule, test.after.In(test.loc), got, test.want.In(test.loc))
+		}
+		if got.Location() != test.loc {
+			t.Errorf("%s: Next(%q) is in %s, want %s", test.name, test.rule, got.Location(), test.loc)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+//------------------------ ERRORS --------------------------------------------------//
+// Error codes are part of the API, clients match on them instead of on the messages so they never change
+const (
+	codeInvalidRequest     = "invalid_request"
+	codeValidationFailed   = "validation_failed"
+	codeUnauthorized       = "unauthorized"
+	codeTokenExpired       = "token_expired"
+	codeInvalidToken       = "invalid_token"
+	codeInvalidCredentials = "invalid_credentials"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codePreconditionFailed = "precondition_failed"
+	codeInternal           = "internal_error"
+)
+
+// An error that is safe to show to the client, along with the status and code it is reported with
+type apiError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newError(status int, code string, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+// The request is malformed, such as a body that isn't JSON or a missing path parameter.
+// Errors of the database are passed on as they are so that missing rows still become a 404.
+func invalidRequest(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return err
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return &apiError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "Malformed request body", Details: err.Error()}
+	}
+
+	return newError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+}
+
+// The request is well formed but its values are not acceptable
+func invalid(message string) error {
+	return newError(http.StatusUnprocessableEntity, codeValidationFailed, message)
+}
+
+func forbidden(message string) error {
+	return newError(http.StatusForbidden, codeForbidden, message)
+}
+
+func notFound(message string) error {
+	return newError(http.StatusNotFound, codeNotFound, message)
+}
+
+// The resource has changed since the version the client based its request on
+func preconditionFailed(message string) error {
+	return newError(http.StatusPreconditionFailed, codePreconditionFailed, message)
+}
+
+// Turns any error into the one reported to the client. Unexpected errors are logged and hidden
+// behind a generic message so that nothing about the database leaks out.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound("The requested resource does not exist").(*apiError)
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return newError(http.StatusConflict, codeConflict, "This already exists")
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return newError(http.StatusConflict, codeConflict, "This already exists")
+	}
+
+	log.Printf("Internal error: %s", err)
+	return newError(http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+// Version 1 of the API keeps answering with the plain message, later versions with a JSON envelope
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := toAPIError(err)
+
+	if apiVersion(r) == "v1" {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	res, _ := json.Marshal(map[string]*apiError{"error": apiErr})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	w.Write(res)
+}
+
+// Reports a missing row as a 404 with the given message, any other error is kept as it is
+func orNotFound(err error, message string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound(message)
+	}
+
+	return err
+}
+
+// Reports a missing row as a validation failure, for rows that are referred to by the body of a request
+func orInvalid(err error, message string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return invalid(message)
+	}
+
+	return err
+}
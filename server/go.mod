@@ -1,11 +1,12 @@
 module server
 
-go 1.13
+go 1.16
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/gorilla/mux v1.7.4
+	github.com/lib/pq v1.9.0
 	github.com/lithammer/shortuuid v3.0.0+incompatible
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"server/models"
+	"server/storage"
+)
+
+// A PDF is one of the types that can be attached to a task
+var testPDF = []byte("%PDF-1.4\n1 0 obj << >> endobj\ntrailer << >>\n%%EOF\n")
+
+// Serves the API over a memory repository holding the units, users and tasks of seedRepository and seedTasks.
+// Every admin also has an invite, a template and a schedule, and t1 and t2 have a comment and an attachment each.
+func newTestServer(t *testing.T) (*httptest.Server, Repository) {
+	prevRepo, prevBlobs, prevSecret, prevCost := repo, blobs, JWT_SECRET, passwordCost
+	t.Cleanup(func() {
+		repo, blobs, JWT_SECRET, passwordCost = prevRepo, prevBlobs, prevSecret, prevCost
+		useServices(newService(repo, blobs))
+	})
+
+	store, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo = newMemoryRepository()
+	blobs = store
+	JWT_SECRET = "test"
+	passwordCost = bcrypt.MinCost
+	useServices(newService(repo, blobs))
+
+	seedRepository(t, repo)
+	seedTasks(t, repo)
+	seedHandlerFixtures(t, repo)
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+
+	return server, repo
+}
+
+func seedHandlerFixtures(t *testing.T, f Repository) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// Only n1 and n3 can log in with a password
+	hash, err := HashPassword("password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"n1", "n3"} {
+		user, err := f.GetUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.UpdateUser(user, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session := session{TokenHash: hashToken("refresh-n1"), User: "n1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := f.CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invite := range []models.Invite{
+		{Code: "inv1", Type: "normal", Unit: "plt1", CreatedBy: "adm1", CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)},
+		{Code: "inv2", Type: "normal", Unit: "dep2", CreatedBy: "adm", CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)},
+		{Code: "inv3", Type: "normal", Unit: "plt1", CreatedBy: "adm1", CreatedAt: now.Add(-48 * time.Hour), ExpiresAt: now.Add(-24 * time.Hour)},
+	} {
+		if err := f.CreateInvite(invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, template := range []models.Template{
+		{Id: "tpl1", Name: "Depot check", DueInDays: 1, Unit: "dep1", CreatedBy: "adm1", CreatedAt: now},
+		{Id: "tpl2", Name: "Battalion check", DueInDays: 1, Unit: "amb", CreatedBy: "adm", CreatedAt: now},
+	} {
+		if err := f.CreateTemplate(template); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, schedule := range []models.Schedule{
+		{Id: "sch1", Template: "tpl1", Rule: "daily", AssignedTo: "n1", CreatedBy: "adm1", CreatedAt: now, NextRun: now.Add(time.Hour), Active: true},
+		{Id: "sch2", Template: "tpl2", Rule: "daily", Unit: "dep2", CreatedBy: "adm", CreatedAt: now, NextRun: now.Add(time.Hour), Active: true},
+	} {
+		if err := f.CreateSchedule(schedule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, task := range []string{"t1", "t2"} {
+		comment := models.Comment{Id: "c-" + task, TaskId: task, Author: "adm", Body: "Looks good", CreatedAt: now}
+		if err := f.CreateComment(comment); err != nil {
+			t.Fatal(err)
+		}
+
+		attachment := models.Attachment{Id: "a-" + task, TaskId: task, UploadedBy: "adm", Filename: "report.pdf",
+			ContentType: "application/pdf", Size: int64(len(testPDF)), CreatedAt: now}
+		if err := blobs.Put(attachment.Id, bytes.NewReader(testPDF)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.CreateAttachment(attachment); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type handlerTest struct {
+	name   string
+	as     string // The user sending the request, the request has no token when this is empty
+	method string
+	path   string
+	body   interface{} // Sent as JSON, or as the file of a multipart form when it is a []byte
+	status int
+}
+
+// Sends the request of the test to a version of the API on the server
+func (test handlerTest) send(t *testing.T, server *httptest.Server, version string) *http.Response {
+	return test.sendWith(t, server, version, nil)
+}
+
+// Sends the request of the test with extra headers
+func (test handlerTest) sendWith(t *testing.T, server *httptest.Server, version string, header http.Header) *http.Response {
+	var body io.Reader
+	contentType := "application/json"
+
+	switch b := test.body.(type) {
+	case nil:
+	case []byte:
+		buf := &bytes.Buffer{}
+		form := multipart.NewWriter(buf)
+		part, err := form.CreateFormFile("file", "upload.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(b)
+		form.Close()
+		body, contentType = buf, form.FormDataContentType()
+	case string:
+		body = strings.NewReader(b)
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(test.method, server.URL+"/api/"+version+test.path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if test.as != "" {
+		req.Header.Set("Authorization", "Bearer "+testToken(t, test.as))
+	}
+
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+// The type claim is ignored by the server, the role is read from the user table
+func testToken(t *testing.T, uid string) string {
+	token, err := createJWT(uid, "normal", JWT_SECRET, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Expands a request on a task into the permission matrix: the assignee of t1, another normal user, the admin of
+// the depot of t1 and the same admin on t2, which is outside of its scope. The path formats the task id.
+func onTask(name string, method string, path string, body interface{}, owner, other, inScope, outOfScope int) []handlerTest {
+	return []handlerTest{
+		{name + " as the assignee", "n1", method, fmt.Sprintf(path, "t1"), body, owner},
+		{name + " as another normal user", "n2", method, fmt.Sprintf(path, "t1"), body, other},
+		{name + " as an admin in scope", "adm1", method, fmt.Sprintf(path, "t1"), body, inScope},
+		{name + " as an admin out of scope", "adm1", method, fmt.Sprintf(path, "t2"), body, outOfScope},
+	}
+}
+
+func handlerTests() []handlerTest {
+	profile := map[string]interface{}{"man": 4, "first_name": "Dan", "last_name": "Delta", "rank": "PTE"}
+	with := func(fields map[string]interface{}) map[string]interface{} {
+		body := map[string]interface{}{}
+		for k, v := range profile {
+			body[k] = v
+		}
+		for k, v := range fields {
+			body[k] = v
+		}
+		return body
+	}
+
+	tests := []handlerTest{
+		// Sessions
+		{"login", "", "POST", "/login", map[string]string{"username": "n1", "password": "password1"}, http.StatusOK},
+		{"login with a wrong password", "", "POST", "/login", map[string]string{"username": "n1", "password": "password2"}, http.StatusUnauthorized},
+		{"login of a deactivated user", "", "POST", "/login", map[string]string{"username": "n3", "password": "password1"}, http.StatusForbidden},
+		{"login without a password", "", "POST", "/login", map[string]string{"username": "n1"}, http.StatusUnprocessableEntity},
+		{"register", "", "POST", "/register", with(map[string]interface{}{"invite": "inv1", "username": "dan", "password": "password1"}), http.StatusOK},
+		{"register with an expired invite", "", "POST", "/register", with(map[string]interface{}{"invite": "inv3", "username": "dan", "password": "password1"}), http.StatusForbidden},
+		{"register with an unknown invite", "", "POST", "/register", with(map[string]interface{}{"invite": "nope", "username": "dan", "password": "password1"}), http.StatusForbidden},
+		{"refresh", "", "POST", "/token/refresh", map[string]string{"refresh_token": "refresh-n1"}, http.StatusOK},
+		{"refresh with an unknown token", "", "POST", "/token/refresh", map[string]string{"refresh_token": "refresh-n2"}, http.StatusUnauthorized},
+		{"logout", "", "POST", "/logout", map[string]string{"refresh_token": "refresh-n1"}, http.StatusOK},
+
+		// Authentication
+		{"request without a token", "", "GET", "/users/self", nil, http.StatusUnauthorized},
+		{"request of an unknown user", "n9", "GET", "/users/self", nil, http.StatusUnauthorized},
+		{"request of a deactivated user", "n3", "GET", "/users/self", nil, http.StatusForbidden},
+		{"request with an unknown field", "adm1", "POST", "/templates", map[string]interface{}{"name": "Check", "colour": "red"}, http.StatusBadRequest},
+
+		// Users
+		{"get self", "n1", "GET", "/users/self", nil, http.StatusOK},
+		{"get self as an admin", "adm1", "GET", "/users/self", nil, http.StatusOK},
+		{"get user as themselves", "n1", "GET", "/users/n1", nil, http.StatusForbidden},
+		{"get user as another normal user", "n2", "GET", "/users/n1", nil, http.StatusForbidden},
+		{"get user as an admin in scope", "adm1", "GET", "/users/n1", nil, http.StatusOK},
+		{"get user as an admin out of scope", "adm1", "GET", "/users/n2", nil, http.StatusForbidden},
+		{"get unknown user", "adm", "GET", "/users/n9", nil, http.StatusForbidden},
+		{"update user as themselves", "n1", "PUT", "/users/n1", with(map[string]interface{}{"username": "ann", "type": "normal", "unit": "plt1"}), http.StatusForbidden},
+		{"update user as an admin in scope", "adm1", "PUT", "/users/n1", with(map[string]interface{}{"username": "ann", "type": "normal", "unit": "plt1"}), http.StatusOK},
+		{"update user as an admin out of scope", "adm1", "PUT", "/users/n2", with(map[string]interface{}{"username": "ben", "type": "normal", "unit": "dep2"}), http.StatusForbidden},
+		{"move user out of scope", "adm1", "PUT", "/users/n1", with(map[string]interface{}{"username": "ann", "type": "normal", "unit": "dep2"}), http.StatusForbidden},
+		{"update an admin below", "adm", "PUT", "/users/adm1", with(map[string]interface{}{"username": "adm1", "type": "admin", "unit": "dep1"}), http.StatusOK},
+		{"update an admin above", "adm1", "PUT", "/users/adm", with(map[string]interface{}{"username": "adm", "type": "admin", "unit": "amb"}), http.StatusForbidden},
+		{"make an admin in the same unit", "adm1", "PUT", "/users/n1", with(map[string]interface{}{"username": "ann", "type": "admin", "unit": "dep1"}), http.StatusForbidden},
+		{"deactivate user as themselves", "n1", "DELETE", "/users/n1", nil, http.StatusForbidden},
+		{"deactivate user as an admin in scope", "adm1", "DELETE", "/users/n1", nil, http.StatusOK},
+		{"deactivate user as an admin out of scope", "adm1", "DELETE", "/users/n2", nil, http.StatusForbidden},
+		{"list user tasks as themselves", "n1", "GET", "/users/n1/tasks", nil, http.StatusOK},
+		{"list user tasks as another normal user", "n2", "GET", "/users/n1/tasks", nil, http.StatusForbidden},
+		{"list user tasks as an admin in scope", "adm1", "GET", "/users/n1/tasks", nil, http.StatusOK},
+		{"list user tasks as an admin out of scope", "adm1", "GET", "/users/n2/tasks", nil, http.StatusForbidden},
+		{"list users as a normal user", "n1", "GET", "/users", nil, http.StatusForbidden},
+		{"list users as an admin", "adm1", "GET", "/users", nil, http.StatusOK},
+		{"create user as a normal user", "n1", "POST", "/users", with(map[string]interface{}{"username": "dan", "password": "password1", "type": "normal", "unit": "plt1"}), http.StatusForbidden},
+		{"create user as an admin in scope", "adm1", "POST", "/users", with(map[string]interface{}{"username": "dan", "password": "password1", "type": "normal", "unit": "plt1"}), http.StatusOK},
+		{"create user as an admin out of scope", "adm1", "POST", "/users", with(map[string]interface{}{"username": "dan", "password": "password1", "type": "normal", "unit": "dep2"}), http.StatusForbidden},
+		{"create user with a taken username", "adm1", "POST", "/users", with(map[string]interface{}{"username": "adm", "password": "password1", "type": "normal", "unit": "plt1"}), http.StatusConflict},
+
+		// Invites
+		{"list invites as a normal user", "n1", "GET", "/invites", nil, http.StatusForbidden},
+		{"list invites as an admin", "adm1", "GET", "/invites", nil, http.StatusOK},
+		{"create invite as a normal user", "n1", "POST", "/invites", map[string]string{"type": "normal", "unit": "plt1"}, http.StatusForbidden},
+		{"create invite as an admin in scope", "adm1", "POST", "/invites", map[string]string{"type": "normal", "unit": "plt1"}, http.StatusOK},
+		{"create invite as an admin out of scope", "adm1", "POST", "/invites", map[string]string{"type": "normal", "unit": "dep2"}, http.StatusForbidden},
+		{"delete invite as a normal user", "n1", "DELETE", "/invites/inv1", nil, http.StatusForbidden},
+		{"delete invite as an admin in scope", "adm1", "DELETE", "/invites/inv1", nil, http.StatusOK},
+		{"delete invite as an admin out of scope", "adm1", "DELETE", "/invites/inv2", nil, http.StatusForbidden},
+		{"delete unknown invite", "adm1", "DELETE", "/invites/nope", nil, http.StatusNotFound},
+
+		// Units
+		{"list units as a normal user", "n1", "GET", "/units", nil, http.StatusForbidden},
+		{"list units as an admin", "adm1", "GET", "/units", nil, http.StatusOK},
+		{"create unit as a normal user", "n1", "POST", "/units", map[string]string{"name": "Section 9", "level": "section", "parent": "plt1"}, http.StatusForbidden},
+		{"create unit as an admin in scope", "adm1", "POST", "/units", map[string]string{"name": "Section 9", "level": "section", "parent": "plt1"}, http.StatusOK},
+		{"create unit as an admin out of scope", "adm1", "POST", "/units", map[string]string{"name": "Platoon 9", "level": "platoon", "parent": "dep2"}, http.StatusForbidden},
+		{"create unit at the level of its parent", "adm1", "POST", "/units", map[string]string{"name": "Platoon 9", "level": "platoon", "parent": "plt1"}, http.StatusUnprocessableEntity},
+		{"update unit as a normal user", "n1", "PUT", "/units/plt1", map[string]string{"name": "Platoon One", "level": "platoon", "parent": "dep1"}, http.StatusForbidden},
+		{"update unit as an admin in scope", "adm1", "PUT", "/units/plt1", map[string]string{"name": "Platoon One", "level": "platoon", "parent": "dep1"}, http.StatusOK},
+		{"update unit as an admin out of scope", "adm1", "PUT", "/units/dep2", map[string]string{"name": "Depot Two", "level": "depot", "parent": "amb"}, http.StatusForbidden},
+
+		// Templates
+		{"list templates as a normal user", "n1", "GET", "/templates", nil, http.StatusForbidden},
+		{"list templates as an admin", "adm1", "GET", "/templates", nil, http.StatusOK},
+		{"create template as a normal user", "n1", "POST", "/templates", map[string]interface{}{"name": "Check", "due_in_days": 3}, http.StatusForbidden},
+		{"create template as an admin", "adm1", "POST", "/templates", map[string]interface{}{"name": "Check", "due_in_days": 3}, http.StatusOK},
+		{"delete template as a normal user", "n1", "DELETE", "/templates/tpl1", nil, http.StatusForbidden},
+		{"delete template as an admin in scope", "adm1", "DELETE", "/templates/tpl1", nil, http.StatusOK},
+		{"delete template as an admin out of scope", "adm1", "DELETE", "/templates/tpl2", nil, http.StatusForbidden},
+		{"delete unknown template", "adm1", "DELETE", "/templates/nope", nil, http.StatusNotFound},
+
+		// Schedules
+		{"list schedules as a normal user", "n1", "GET", "/schedules", nil, http.StatusForbidden},
+		{"list schedules as an admin", "adm1", "GET", "/schedules", nil, http.StatusOK},
+		{"create schedule as a normal user", "n1", "POST", "/schedules", map[string]string{"template": "tpl1", "rule": "daily", "assigned_to": "n1"}, http.StatusForbidden},
+		{"create schedule as an admin in scope", "adm1", "POST", "/schedules", map[string]string{"template": "tpl1", "rule": "daily", "assigned_to": "n1"}, http.StatusOK},
+		{"create schedule for a user out of scope", "adm1", "POST", "/schedules", map[string]string{"template": "tpl1", "rule": "daily", "assigned_to": "n2"}, http.StatusForbidden},
+		{"create schedule with a template out of scope", "adm1", "POST", "/schedules", map[string]string{"template": "tpl2", "rule": "daily", "unit": "plt1"}, http.StatusForbidden},
+		{"create schedule with an unknown template", "adm1", "POST", "/schedules", map[string]string{"template": "nope", "rule": "daily", "unit": "plt1"}, http.StatusUnprocessableEntity},
+		{"stop schedule as a normal user", "n1", "DELETE", "/schedules/sch1", nil, http.StatusForbidden},
+		{"stop schedule as an admin in scope", "adm1", "DELETE", "/schedules/sch1", nil, http.StatusOK},
+		{"stop schedule as an admin out of scope", "adm1", "DELETE", "/schedules/sch2", nil, http.StatusForbidden},
+
+		// Task listings and creation
+		{"list tasks as a normal user", "n1", "GET", "/tasks", nil, http.StatusOK},
+		{"list tasks as an admin", "adm1", "GET", "/tasks", nil, http.StatusOK},
+		{"list tasks with an invalid filter", "adm1", "GET", "/tasks?priority=urgent", nil, http.StatusBadRequest},
+		{"create task as a normal user", "n1", "POST", "/tasks", map[string]string{"name": "Check", "assigned_to": "n1"}, http.StatusForbidden},
+		{"create task as an admin in scope", "adm1", "POST", "/tasks", map[string]string{"name": "Check", "assigned_to": "n1"}, http.StatusOK},
+		{"create task as an admin out of scope", "adm1", "POST", "/tasks", map[string]string{"name": "Check", "assigned_to": "n2"}, http.StatusForbidden},
+		{"create task for an admin", "adm", "POST", "/tasks", map[string]string{"name": "Check", "assigned_to": "adm1"}, http.StatusForbidden},
+		{"create task without a name", "adm1", "POST", "/tasks", map[string]string{"assigned_to": "n1"}, http.StatusUnprocessableEntity},
+		{"create task for a deactivated user", "adm1", "POST", "/tasks", map[string]string{"name": "Check", "assigned_to": "n3"}, http.StatusUnprocessableEntity},
+		{"create tasks as a normal user", "n1", "POST", "/tasks/bulk", map[string]interface{}{"name": "Check", "assigned_to": []string{"n1"}}, http.StatusForbidden},
+		{"create tasks as an admin in scope", "adm1", "POST", "/tasks/bulk", map[string]interface{}{"name": "Check", "unit": "plt1"}, http.StatusOK},
+		{"create tasks as an admin out of scope", "adm1", "POST", "/tasks/bulk", map[string]interface{}{"name": "Check", "unit": "dep2"}, http.StatusForbidden},
+
+		// Task updates, see TestHandlerTaskUpdates for every field
+		{"replace task as the assignee", "n1", "PUT", "/tasks/t1", map[string]string{"name": "Alpha inspection", "assigned_to": "n1", "status": "in_progress"}, http.StatusOK},
+		{"replace task as another normal user", "n2", "PUT", "/tasks/t1", map[string]string{"name": "Alpha inspection", "assigned_to": "n1", "status": "in_progress"}, http.StatusForbidden},
+		{"replace task as an admin in scope", "adm1", "PUT", "/tasks/t1", map[string]string{"name": "Renamed", "assigned_to": "n1", "status": "assigned"}, http.StatusOK},
+		{"replace task as an admin out of scope", "adm1", "PUT", "/tasks/t2", map[string]string{"name": "Renamed", "assigned_to": "n2", "status": "assigned"}, http.StatusForbidden},
+		{"replace task with another id", "adm1", "PUT", "/tasks/t1", map[string]string{"id": "t3", "name": "Renamed", "assigned_to": "n1", "status": "assigned"}, http.StatusUnprocessableEntity},
+		{"patch task as the assignee", "n1", "PATCH", "/tasks/t1", map[string]string{"status": "in_progress"}, http.StatusOK},
+		{"patch task as another normal user", "n2", "PATCH", "/tasks/t1", map[string]string{"status": "in_progress"}, http.StatusForbidden},
+		{"patch task as an admin in scope", "adm1", "PATCH", "/tasks/t1", map[string]string{"name": "Renamed"}, http.StatusOK},
+		{"patch task as an admin out of scope", "adm1", "PATCH", "/tasks/t2", map[string]string{"name": "Renamed"}, http.StatusForbidden},
+		{"patch unknown task", "adm1", "PATCH", "/tasks/t9", map[string]string{"name": "Renamed"}, http.StatusNotFound},
+		{"update task as the assignee", "n1", "PUT", "/tasks", map[string]string{"id": "t1", "name": "Alpha inspection", "assigned_to": "n1", "status": "in_progress"}, http.StatusOK},
+		{"update task as another normal user", "n2", "PUT", "/tasks", map[string]string{"id": "t1", "name": "Alpha inspection", "assigned_to": "n1", "status": "in_progress"}, http.StatusForbidden},
+		{"update task as an admin in scope", "adm1", "PUT", "/tasks", map[string]string{"id": "t1", "name": "Renamed", "assigned_to": "n1", "status": "assigned"}, http.StatusOK},
+		{"update task as an admin out of scope", "adm1", "PUT", "/tasks", map[string]string{"id": "t2", "name": "Renamed", "assigned_to": "n2", "status": "assigned"}, http.StatusForbidden},
+		{"delete task by body as the assignee", "n1", "DELETE", "/tasks", map[string]string{"id": "t1"}, http.StatusForbidden},
+		{"delete task by body as an admin in scope", "adm1", "DELETE", "/tasks", map[string]string{"id": "t1"}, http.StatusOK},
+		{"delete task by body as an admin out of scope", "adm1", "DELETE", "/tasks", map[string]string{"id": "t2"}, http.StatusForbidden},
+
+		// Audit
+		{"audit feed as a normal user", "n1", "GET", "/audit", nil, http.StatusForbidden},
+		{"audit feed as an admin", "adm1", "GET", "/audit", nil, http.StatusOK},
+	}
+
+	tests = append(tests, onTask("get task", "GET", "/tasks/%s", nil, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("delete task", "DELETE", "/tasks/%s", nil, http.StatusForbidden, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("task history", "GET", "/tasks/%s/history", nil, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("list comments", "GET", "/tasks/%s/comments", nil, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("create comment", "POST", "/tasks/%s/comments", map[string]string{"body": "Done"}, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("list attachments", "GET", "/tasks/%s/attachments", nil, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("upload attachment", "POST", "/tasks/%s/attachments", testPDF, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+	tests = append(tests, onTask("download attachment", "GET", "/tasks/%[1]s/attachments/a-%[1]s", nil, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden)...)
+
+	tests = append(tests,
+		handlerTest{"get unknown task", "adm1", "GET", "/tasks/t9", nil, http.StatusNotFound},
+		handlerTest{"create empty comment", "n1", "POST", "/tasks/t1/comments", map[string]string{"body": " "}, http.StatusUnprocessableEntity},
+		handlerTest{"upload a file that is not an image or a PDF", "n1", "POST", "/tasks/t1/attachments", []byte("plain text"), http.StatusUnprocessableEntity},
+		handlerTest{"download an attachment of another task", "n1", "GET", "/tasks/t1/attachments/a-t2", nil, http.StatusNotFound},
+	)
+
+	return tests
+}
+
+// Every route answers every version of the API with the same status, only the format of the errors differs
+func TestHandlers(t *testing.T) {
+	for _, version := range apiVersions {
+		for _, test := range handlerTests() {
+			test := test
+			t.Run(version+"/"+test.name, func(t *testing.T) {
+				server, _ := newTestServer(t)
+
+				res := test.send(t, server, version)
+				if res.StatusCode != test.status {
+					body, _ := io.ReadAll(res.Body)
+					t.Fatalf("%s %s as %q = %d %s, want %d", test.method, test.path, test.as, res.StatusCode, body, test.status)
+				}
+
+				// Version 2 reports errors in an envelope with a code
+				if version == "v2" && res.StatusCode != http.StatusOK {
+					var envelope struct {
+						Error apiError `json:"error"`
+					}
+					if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil || envelope.Error.Code == "" {
+						t.Errorf("error response is not an envelope: %v %+v", err, envelope)
+					}
+				}
+			})
+		}
+	}
+}
+
+// The listings only hold the tasks within the scope of the user
+func TestHandlerTaskListings(t *testing.T) {
+	tests := []struct {
+		as   string
+		path string
+		want []string
+	}{
+		{"n1", "/tasks", []string{"t1", "t3"}},
+		{"n2", "/tasks", []string{"t2"}},
+		{"adm1", "/tasks", []string{"t1", "t3"}},
+		{"adm", "/tasks", []string{"t1", "t2", "t3"}},
+		{"adm1", "/users/n1/tasks", []string{"t1", "t3"}},
+		{"adm", "/tasks?priority=high", []string{"t1"}},
+		{"adm", "/tasks?tag=weekly", []string{"t1", "t3"}},
+		{"adm", "/tasks?overdue=true", []string{"t2", "t3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.as+test.path, func(t *testing.T) {
+			server, _ := newTestServer(t)
+
+			res := handlerTest{as: test.as, method: "GET", path: test.path}.send(t, server, "v2")
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+
+			var page struct {
+				Items []taskResponse `json:"items"`
+				Total int            `json:"total"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []string{}
+			for _, task := range page.Items {
+				ids = append(ids, task.Id)
+			}
+			sort.Strings(ids)
+
+			if strings.Join(ids, ",") != strings.Join(test.want, ",") || page.Total != len(test.want) {
+				t.Errorf("tasks = %v (total %d), want %v", ids, page.Total, test.want)
+			}
+		})
+	}
+}
+
+// The same task as each version of the API gives it: version 1 names the assigner and verifier, version 2
+// gives their users, and null for a task nobody has verified yet
+func TestHandlerVersionBodies(t *testing.T) {
+	server, repo := newTestServer(t)
+	setTestTaskStatus(t, repo, "t1", "verified")
+
+	adm := map[string]interface{}{"id": "adm", "rank": "CPT", "first_name": "Amb", "last_name": "Admin"}
+	adm1 := map[string]interface{}{"id": "adm1", "rank": "LTA", "first_name": "Depot", "last_name": "Admin"}
+	n1 := map[string]interface{}{"id": "n1", "rank": "CPL", "first_name": "Ann", "last_name": "Alpha"}
+
+	tests := []struct {
+		path string
+		item bool // The task is the first item of a listing
+		want map[string]map[string]interface{}
+	}{
+		{"/tasks/t1", false, map[string]map[string]interface{}{
+			"v1": {"assigned_to": "n1", "assigned_by": "LTA Depot Admin", "verified_by": "CPT Amb Admin"},
+			"v2": {"assigned_to": n1, "assigned_by": adm1, "verified_by": adm},
+		}},
+		{"/tasks/t3", false, map[string]map[string]interface{}{
+			"v1": {"assigned_to": "n1", "assigned_by": "CPT Amb Admin", "verified_by": "  "},
+			"v2": {"assigned_to": n1, "assigned_by": adm, "verified_by": nil},
+		}},
+		{"/tasks?search=Alpha", true, map[string]map[string]interface{}{
+			"v1": {"assigned_to": "n1", "assigned_by": "LTA Depot Admin", "verified_by": "CPT Amb Admin"},
+			"v2": {"assigned_to": n1, "assigned_by": adm1, "verified_by": adm},
+		}},
+	}
+
+	for _, test := range tests {
+		for _, version := range apiVersions {
+			res := handlerTest{as: "adm", method: "GET", path: test.path}.send(t, server, version)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("%s GET %s = %d", version, test.path, res.StatusCode)
+			}
+
+			var task map[string]interface{}
+			if test.item {
+				var page struct {
+					Items []map[string]interface{} `json:"items"`
+				}
+				if err := json.NewDecoder(res.Body).Decode(&page); err != nil || len(page.Items) == 0 {
+					t.Fatalf("%s GET %s = %+v, %v", version, test.path, page, err)
+				}
+				task = page.Items[0]
+			} else if err := json.NewDecoder(res.Body).Decode(&task); err != nil {
+				t.Fatal(err)
+			}
+
+			for field, want := range test.want[version] {
+				if got, ok := task[field]; !ok || !reflect.DeepEqual(got, want) {
+					t.Errorf("%s GET %s %s = %#v, want %#v", version, test.path, field, got, want)
+				}
+			}
+		}
+	}
+}
+
+// The same error as each version of the API gives it: version 1 as plain text, version 2 in a JSON envelope
+func TestHandlerVersionErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	tests := []struct {
+		name    string
+		test    handlerTest
+		code    string
+		message string
+	}{
+		{"missing task", handlerTest{as: "adm1", method: "GET", path: "/tasks/t9", status: http.StatusNotFound},
+			codeNotFound, "Task not found"},
+		{"out of scope", handlerTest{as: "adm1", method: "GET", path: "/tasks/t2", status: http.StatusForbidden},
+			codeForbidden, "This user doesn't have permissions to view this task"},
+		{"invalid value", handlerTest{as: "adm1", method: "POST", path: "/tasks", body: map[string]string{"name": "Check", "assigned_to": "n3"}, status: http.StatusUnprocessableEntity},
+			codeValidationFailed, "This user has been deactivated"},
+	}
+
+	for _, test := range tests {
+		res := test.test.send(t, server, "v1")
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != test.test.status || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") || string(body) != test.message+"\n" {
+			t.Errorf("%s: v1 = %d %s %q, want %d text/plain %q", test.name, res.StatusCode, res.Header.Get("Content-Type"), body, test.test.status, test.message)
+		}
+
+		res = test.test.send(t, server, "v2")
+		var envelope map[string]map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+			t.Fatalf("%s: v2 body is not JSON: %v", test.name, err)
+		}
+		if res.StatusCode != test.test.status || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") ||
+			envelope["error"]["code"] != test.code || envelope["error"]["message"] != test.message {
+			t.Errorf("%s: v2 = %d %s %v, want %d application/json %s %q", test.name, res.StatusCode, res.Header.Get("Content-Type"), envelope, test.test.status, test.code, test.message)
+		}
+	}
+}
+
+// A refresh token can only be used once, and logging out revokes it
+func TestHandlerSessions(t *testing.T) {
+	server, _ := newTestServer(t)
+	refresh := map[string]string{"refresh_token": "refresh-n1"}
+
+	res := handlerTest{method: "POST", path: "/token/refresh", body: refresh}.send(t, server, "v2")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh status = %d", res.StatusCode)
+	}
+
+	var session loginUserResponse
+	if err := json.NewDecoder(res.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Id != "n1" || session.Jwt == "" || session.RefreshToken == "" {
+		t.Errorf("refresh = %+v", session)
+	}
+
+	if res := (handlerTest{method: "POST", path: "/token/refresh", body: refresh}).send(t, server, "v2"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("reused refresh token status = %d, want 401", res.StatusCode)
+	}
+
+	next := map[string]string{"refresh_token": session.RefreshToken}
+	if res := (handlerTest{method: "POST", path: "/logout", body: next}).send(t, server, "v2"); res.StatusCode != http.StatusOK {
+		t.Errorf("logout status = %d", res.StatusCode)
+	}
+
+	if res := (handlerTest{method: "POST", path: "/token/refresh", body: next}).send(t, server, "v2"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh after logout status = %d, want 401", res.StatusCode)
+	}
+}
+
+// Bulk creation reports every assignee, and an empty list when the unit has nobody to assign
+func TestHandlerBulkTaskCreation(t *testing.T) {
+	server, repo := newTestServer(t)
+	if err := repo.CreateUnit(models.Unit{Id: "sec1", Name: "Section 1", Level: "section", Parent: "plt1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body map[string]interface{}
+		want []createTasksResult
+	}{
+		{map[string]interface{}{"name": "Check", "unit": "sec1"}, []createTasksResult{}},
+		{map[string]interface{}{"name": "Check", "unit": "plt1"}, []createTasksResult{{AssignedTo: "n1"}}},
+		{map[string]interface{}{"name": "Check", "assigned_to": []string{"n1", "n3", "n1"}},
+			[]createTasksResult{{AssignedTo: "n1"}, {AssignedTo: "n3", Error: "This user has been deactivated"}}},
+	}
+
+	for _, test := range tests {
+		res := handlerTest{as: "adm1", method: "POST", path: "/tasks/bulk", body: test.body}.send(t, server, "v2")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("POST /tasks/bulk %v = %d", test.body, res.StatusCode)
+		}
+
+		var results []createTasksResult
+		if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		if results == nil {
+			t.Errorf("POST /tasks/bulk %v = null, want a list", test.body)
+			continue
+		}
+
+		// The ids of the new tasks are random
+		for i := range results {
+			if results[i].Error == "" && results[i].Task == "" {
+				t.Errorf("POST /tasks/bulk %v created no task for %s", test.body, results[i].AssignedTo)
+			}
+			results[i].Task = ""
+		}
+		if !reflect.DeepEqual(results, test.want) {
+			t.Errorf("POST /tasks/bulk %v = %+v, want %+v", test.body, results, test.want)
+		}
+	}
+}
+
+// Demotions and deactivations apply to the very next request of the user, whatever the token says
+func TestHandlerAccessChangesApplyAtOnce(t *testing.T) {
+	profile := map[string]interface{}{"man": 4, "first_name": "Ann", "last_name": "Alpha", "rank": "PTE"}
+	demote := map[string]interface{}{"username": "adm1", "type": "normal", "unit": "dep1"}
+	for k, v := range profile {
+		demote[k] = v
+	}
+
+	steps := []handlerTest{
+		{"admin lists the audit feed", "adm1", "GET", "/audit", nil, http.StatusOK},
+		{"user reads themselves", "n1", "GET", "/users/self", nil, http.StatusOK},
+		{"demote the admin", "adm", "PUT", "/users/adm1", demote, http.StatusOK},
+		{"demoted admin lists the audit feed", "adm1", "GET", "/audit", nil, http.StatusForbidden},
+		{"demoted admin creates a task", "adm1", "POST", "/tasks", map[string]string{"name": "Check", "assigned_to": "n1"}, http.StatusForbidden},
+		{"deactivate the user", "adm", "DELETE", "/users/n1", nil, http.StatusOK},
+		{"deactivated user reads themselves", "n1", "GET", "/users/self", nil, http.StatusForbidden},
+	}
+
+	for _, version := range apiVersions {
+		server, _ := newTestServer(t)
+
+		for _, step := range steps {
+			if res := step.send(t, server, version); res.StatusCode != step.status {
+				t.Fatalf("%s: %s %s as %q = %d, want %d", version, step.method, step.path, step.as, res.StatusCode, step.status)
+			}
+		}
+	}
+}
+
+// Attachments come back as they were uploaded
+func TestHandlerAttachments(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res := handlerTest{as: "n1", method: "POST", path: "/tasks/t1/attachments", body: testPDF}.send(t, server, "v2")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("upload status = %d", res.StatusCode)
+	}
+
+	var attachment models.Attachment
+	if err := json.NewDecoder(res.Body).Decode(&attachment); err != nil {
+		t.Fatal(err)
+	}
+	if attachment.ContentType != "application/pdf" || attachment.Filename != "upload.pdf" || attachment.UploadedBy != "n1" {
+		t.Errorf("attachment = %+v", attachment)
+	}
+
+	res = handlerTest{as: "adm1", method: "GET", path: "/tasks/t1/attachments/" + attachment.Id}.send(t, server, "v2")
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, testPDF) || res.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("download = %d %q %q", res.StatusCode, res.Header.Get("Content-Type"), body)
+	}
+
+	// The attachments are removed along with the task
+	if res := (handlerTest{as: "adm1", method: "DELETE", path: "/tasks/t1"}).send(t, server, "v2"); res.StatusCode != http.StatusOK {
+		t.Fatalf("delete status = %d", res.StatusCode)
+	}
+	if _, err := blobs.Get(attachment.Id); err == nil {
+		t.Error("attachment of a deleted task is still stored")
+	}
+}
+
+// Moves a task to a status directly in the repository, the way it would have got there through the workflow
+func setTestTaskStatus(t *testing.T, f Repository, id string, status string) {
+	prev, err := f.GetTask(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := prev
+	setTaskStatus(&task, status, "Redo", "adm")
+	task.Version = prev.Version + 1
+
+	if err := f.UpdateTask("adm", prev, task); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every field of a task update under each of the roles: the assignee of t1, the admin of its depot, and the same
+// admin on t2, which is outside of its scope. Assignees can only change the status, and admins only act in scope.
+func TestHandlerTaskUpdates(t *testing.T) {
+	type cell struct {
+		as     string
+		task   string
+		status int
+	}
+
+	fields := []struct {
+		name  string
+		body  map[string]interface{}
+		cells []cell
+	}{
+		{"name", map[string]interface{}{"name": "Renamed"},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 200}, {"adm1", "t2", 403}}},
+		{"assignee within the scope", map[string]interface{}{"assigned_to": "n4"},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 200}, {"adm1", "t2", 403}}},
+		{"assignee outside of the scope", map[string]interface{}{"assigned_to": "n2"},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 403}, {"adm", "t1", 200}}},
+		{"assignee that is an admin", map[string]interface{}{"assigned_to": "adm1"},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 403}, {"adm", "t1", 403}}},
+		{"due date", map[string]interface{}{"due_at": time.Now().Add(72 * time.Hour).UTC().Truncate(time.Second)},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 200}, {"adm1", "t2", 403}}},
+		{"priority", map[string]interface{}{"priority": "low"},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 200}, {"adm1", "t2", 403}}},
+		{"category", map[string]interface{}{"category": "Stores"},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 200}, {"adm1", "t2", 403}}},
+		{"tags", map[string]interface{}{"tags": []string{"monthly"}},
+			[]cell{{"n1", "t1", 403}, {"adm1", "t1", 200}, {"adm1", "t2", 403}}},
+	}
+
+	for _, field := range fields {
+		for _, c := range field.cells {
+			t.Run(fmt.Sprintf("%s as %s on %s", field.name, c.as, c.task), func(t *testing.T) {
+				server, f := newTestServer(t)
+
+				// The other normal user of the depot of t1
+				n4 := models.User{Id: "n4", Username: "n4", Utype: "normal", Unit: "plt1", Man: 4, FirstName: "Dan", LastName: "Delta", Rank: "PTE", Active: true}
+				if err := f.CreateUser(n4, "hash-n4"); err != nil {
+					t.Fatal(err)
+				}
+
+				prev, err := f.GetTask(c.task)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				res := handlerTest{as: c.as, method: "PATCH", path: "/tasks/" + c.task, body: field.body}.send(t, server, "v2")
+				if res.StatusCode != c.status {
+					body, _ := io.ReadAll(res.Body)
+					t.Fatalf("status = %d %s, want %d", res.StatusCode, body, c.status)
+				}
+
+				task, err := f.GetTask(c.task)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Refused updates leave the task as it was, accepted ones make a new version
+				if c.status != http.StatusOK && task.Version != prev.Version {
+					t.Errorf("refused update changed the task to version %d", task.Version)
+				}
+				if c.status == http.StatusOK && task.Version != prev.Version+1 {
+					t.Errorf("version = %d, want %d", task.Version, prev.Version+1)
+				}
+			})
+		}
+	}
+
+	// The moves each role can make, every other one is refused
+	moves := map[string]map[string]bool{
+		"normal": {"assigned>in_progress": true, "in_progress>submitted": true, "rejected>in_progress": true},
+		"admin":  {"submitted>verified": true, "submitted>rejected": true},
+	}
+
+	actors := []struct {
+		as   string
+		role string
+		task string
+	}{
+		{"n1", "normal", "t1"},
+		{"adm1", "admin", "t1"},
+		{"adm1", "out of scope", "t2"},
+	}
+
+	for _, from := range taskStatuses {
+		for _, to := range taskStatuses {
+			if from == to {
+				continue
+			}
+
+			for _, actor := range actors {
+				from, to, actor := from, to, actor
+				t.Run(fmt.Sprintf("status %s to %s as %s on %s", from, to, actor.as, actor.task), func(t *testing.T) {
+					server, f := newTestServer(t)
+					if from != "assigned" {
+						setTestTaskStatus(t, f, actor.task, from)
+					}
+
+					body := map[string]interface{}{"status": to}
+					if to == "rejected" {
+						body["rejection_reason"] = "Missing photos"
+					}
+
+					want := http.StatusForbidden
+					if moves[actor.role][from+">"+to] {
+						want = http.StatusOK
+					}
+
+					res := handlerTest{as: actor.as, method: "PATCH", path: "/tasks/" + actor.task, body: body}.send(t, server, "v2")
+					if res.StatusCode != want {
+						body, _ := io.ReadAll(res.Body)
+						t.Fatalf("status = %d %s, want %d", res.StatusCode, body, want)
+					}
+
+					task, err := f.GetTask(actor.task)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if (want == http.StatusOK) != (task.Status == to) {
+						t.Errorf("task is %s after a move to %s with status %d", task.Status, to, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+// Clients that leave fields out of an update keep them as they are
+func TestHandlerTaskUpdateKeepsOmittedFields(t *testing.T) {
+	server, f := newTestServer(t)
+
+	prev, err := f.GetTask("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := map[string]string{"name": prev.Name, "assigned_to": "n1", "status": "in_progress"}
+	res := handlerTest{as: "n1", method: "PUT", path: "/tasks/t1", body: body}.send(t, server, "v2")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", res.StatusCode)
+	}
+
+	task, err := f.GetTask("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Status != "in_progress" || task.Priority != prev.Priority || task.Category != prev.Category ||
+		strings.Join(task.Tags, ",") != strings.Join(prev.Tags, ",") || !task.DueAt.Equal(*prev.DueAt) {
+		t.Errorf("task = %+v, want the fields of %+v", task, prev)
+	}
+}
+
+// Tasks carry their version as an ETag, updates naming an older one with If-Match or in the body are refused
+func TestHandlerTaskVersions(t *testing.T) {
+	server, f := newTestServer(t)
+
+	ifMatch := func(etag string) http.Header {
+		return http.Header{"If-Match": {etag}}
+	}
+
+	steps := []struct {
+		name   string
+		test   handlerTest
+		header http.Header
+		status int
+		etag   string
+	}{
+		{"read", handlerTest{as: "adm1", method: "GET", path: "/tasks/t1"}, nil, 200, `"1"`},
+		{"patch the version read", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]string{"name": "Renamed"}}, ifMatch(`"1"`), 200, `"2"`},
+		{"read the new version", handlerTest{as: "adm1", method: "GET", path: "/tasks/t1"}, nil, 200, `"2"`},
+		{"patch an old version", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]string{"name": "Stale"}}, ifMatch(`"1"`), 412, ""},
+		{"patch an old version in the body", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]interface{}{"name": "Stale", "version": 1}}, nil, 412, ""},
+		{"patch a weak ETag", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]string{"name": "Stale"}}, ifMatch(`W/"2"`), 412, ""},
+		{"replace an old version", handlerTest{as: "adm1", method: "PUT", path: "/tasks/t1", body: map[string]string{"name": "Stale", "assigned_to": "n1", "status": "assigned"}}, ifMatch(`"1"`), 412, ""},
+		{"replace the version read", handlerTest{as: "adm1", method: "PUT", path: "/tasks/t1", body: map[string]string{"name": "Replaced", "assigned_to": "n1", "status": "assigned"}}, ifMatch(`"2"`), 200, `"3"`},
+		{"update an old version", handlerTest{as: "adm1", method: "PUT", path: "/tasks", body: map[string]interface{}{"id": "t1", "name": "Stale", "assigned_to": "n1", "status": "assigned", "version": 2}}, nil, 412, ""},
+		{"update the version read", handlerTest{as: "adm1", method: "PUT", path: "/tasks", body: map[string]interface{}{"id": "t1", "name": "Updated", "assigned_to": "n1", "status": "assigned"}}, ifMatch(`"3"`), 200, `"4"`},
+		{"patch without a condition", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]string{"priority": "low"}}, ifMatch("*"), 200, `"5"`},
+		// An update that changes nothing keeps the version, so that it doesn't fail the updates of other clients
+		{"patch nothing", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]string{"name": "Updated", "priority": "low"}}, ifMatch(`"5"`), 200, `"5"`},
+		{"patch an empty body", handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]string{}}, nil, 200, `"5"`},
+		{"replace with the same fields", handlerTest{as: "adm1", method: "PUT", path: "/tasks/t1", body: map[string]string{"name": "Updated", "assigned_to": "n1", "status": "assigned"}}, ifMatch(`"5"`), 200, `"5"`},
+	}
+
+	for _, step := range steps {
+		res := step.test.sendWith(t, server, "v2", step.header)
+		if res.StatusCode != step.status {
+			body, _ := io.ReadAll(res.Body)
+			t.Fatalf("%s: status = %d %s, want %d", step.name, res.StatusCode, body, step.status)
+		}
+		if etag := res.Header.Get("ETag"); etag != step.etag {
+			t.Errorf("%s: ETag = %q, want %q", step.name, etag, step.etag)
+		}
+
+		if step.status == http.StatusOK && step.test.method != "GET" && step.test.path != "/tasks" {
+			var task taskResponse
+			if err := json.NewDecoder(res.Body).Decode(&task); err != nil {
+				t.Fatal(err)
+			}
+			if etag := taskETag(models.Task{Version: task.Version}); etag != step.etag {
+				t.Errorf("%s: returned version %d, want the ETag %s", step.name, task.Version, step.etag)
+			}
+		}
+	}
+
+	task, err := f.GetTask("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Name != "Updated" || task.Priority != "low" || task.Version != 5 {
+		t.Errorf("task is %q with priority %s at version %d, want Updated with priority low at version 5", task.Name, task.Priority, task.Version)
+	}
+}
+
+// A due date is removed with null, by the users who can change it
+func TestHandlerTaskUpdateClearsDueDate(t *testing.T) {
+	server, f := newTestServer(t)
+
+	res := handlerTest{as: "n1", method: "PATCH", path: "/tasks/t1", body: "{\"due_at\": null}"}.send(t, server, "v2")
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("clearing the due date as the assignee gave status %d, want 403", res.StatusCode)
+	}
+
+	res = handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: "{\"due_at\": null}"}.send(t, server, "v2")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("clearing the due date as an admin gave status %d, want 200", res.StatusCode)
+	}
+
+	task, err := f.GetTask("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.DueAt != nil || task.Version != 2 {
+		t.Errorf("task is due at %v at version %d, want no due date at version 2", task.DueAt, task.Version)
+	}
+
+	// Tasks without a due date are set one like any other field
+	due := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	res = handlerTest{as: "adm1", method: "PATCH", path: "/tasks/t1", body: map[string]interface{}{"due_at": due}}.send(t, server, "v2")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("setting the due date gave status %d, want 200", res.StatusCode)
+	}
+	if task, _ := f.GetTask("t1"); task.DueAt == nil || !task.DueAt.Equal(due) {
+		t.Errorf("task is due at %v, want %s", task.DueAt, due)
+	}
+}
+
+// The fields that follow from the workflow cannot be sent, except by version 1 clients replacing the task they read
+func TestHandlerTaskUpdateRefusesReadOnlyFields(t *testing.T) {
+	server, f := newTestServer(t)
+
+	for field, value := range map[string]interface{}{
+		"assigned_by":  "adm",
+		"verified_by":  "adm",
+		"created_at":   time.Now().UTC(),
+		"submitted_at": time.Now().UTC(),
+		"verified_at":  nil,
+		"updated_at":   time.Now().UTC(),
+		"assignee":     map[string]string{"id": "n1"},
+		"assigner":     map[string]string{"id": "adm"},
+		"verifier":     nil,
+	} {
+		patch := map[string]interface{}{"name": "Renamed", field: value}
+		replace := map[string]interface{}{"name": "Renamed", "assigned_to": "n1", "status": "assigned", field: value}
+
+		for _, test := range []handlerTest{
+			{as: "adm1", method: "PATCH", path: "/tasks/t1", body: patch},
+			{as: "adm1", method: "PUT", path: "/tasks/t1", body: replace},
+		} {
+			res := test.send(t, server, "v2")
+			var envelope struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+				t.Fatal(err)
+			}
+			details, _ := envelope.Error.Details.(map[string]interface{})
+			if res.StatusCode != http.StatusBadRequest || details[field] != "is read only" {
+				t.Errorf("%s with %s gave status %d %+v, want 400 naming the field", test.method, field, res.StatusCode, envelope.Error)
+			}
+		}
+	}
+
+	if task, _ := f.GetTask("t1"); task.Name != "Alpha inspection" || task.Version != 1 {
+		t.Errorf("refused updates changed the task to %q at version %d", task.Name, task.Version)
+	}
+
+	// Version 1 clients send back the whole task they read, its assigner included
+	legacy := map[string]interface{}{"id": "t1", "name": "Renamed", "assigned_to": "n1", "assigned_by": "LTA Depot Admin", "status": "assigned",
+		"created_at": time.Now().UTC(), "verified_by": ""}
+	res := handlerTest{as: "adm1", method: "PUT", path: "/tasks", body: legacy}.send(t, server, "v1")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("version 1 update of the whole task gave status %d, want 200", res.StatusCode)
+	}
+	if task, _ := f.GetTask("t1"); task.Name != "Renamed" || task.AssignedBy != "adm1" {
+		t.Errorf("task is %q assigned by %s, want Renamed assigned by adm1", task.Name, task.AssignedBy)
+	}
+}
+
+// Schedules create tasks for the active users their creator can still reach, and none once the creator is deactivated
+func TestScheduleRuns(t *testing.T) {
+	_, f := newTestServer(t)
+
+	if err := f.SetUserActive("adm1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Add(2 * time.Hour)
+	if err := scheduleService.RunDueSchedules(now); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, _, _, err := f.ListTasks("adm", "admin", dueFilter{}, taskFilter{}, pageRequest{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := map[string][]string{}
+	for _, task := range tasks {
+		if task.CreatedAt.Equal(now) {
+			created[task.Name] = append(created[task.Name], task.AssignedTo)
+		}
+	}
+
+	if len(created) != 1 || len(created["Battalion check"]) != 1 || created["Battalion check"][0] != "n2" {
+		t.Errorf("RunDueSchedules created %v, want Battalion check for n2 only", created)
+	}
+
+	// The schedule of the deactivated admin still moves on to its next run
+	for _, id := range []string{"sch1", "sch2"} {
+		schedule, err := f.GetSchedule(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !schedule.Active || !schedule.NextRun.After(now) {
+			t.Errorf("schedule %s is active %t with its next run at %s, want an active schedule after %s", id, schedule.Active, schedule.NextRun, now)
+		}
+	}
+}
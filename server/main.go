@@ -1,74 +1,243 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	"github.com/lithammer/shortuuid"
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 
+	"server/migrate"
 	"server/models"
+	"server/storage"
 )
 
-var db *sql.DB
-var err error
+var blobs storage.BlobStore
 
 var DB_URL string
 var JWT_SECRET string
+var ATTACHMENT_DIR string
+var SCHEDULE_TIMEZONE string
+
+// Recurrence rules of task schedules are evaluated in this location
+var scheduleLocation = time.UTC
+
+// Access tokens are kept short-lived, sessions are extended with the rotating refresh token instead
+const accessTokenTTL = 15 * time.Minute
+const refreshTokenTTL = 30 * 24 * time.Hour
 
 func main() {
+	migrateCommand := flag.String("migrate", "up", "up applies pending migrations and starts the server, status lists them, "+
+		"dry-run shows the SQL that up would run, baseline marks an existing database created from define.sql as migrated")
+	flag.Parse()
+
 	DB_URL = os.Getenv("DATABASE_URL")
 	JWT_SECRET = os.Getenv("JWT_SECRET")
+	ATTACHMENT_DIR = os.Getenv("ATTACHMENT_DIR")
+	SCHEDULE_TIMEZONE = os.Getenv("SCHEDULE_TIMEZONE")
 
-	// Initialise the global DB pool
-	db, err = sql.Open("sqlite3", DB_URL)
+	// Initialise the global DB pool, the scheme of the URL decides which database is used
+	db, dbDialect, err := openDatabase(DB_URL)
 	if err != nil {
 		panic(err.Error())
 	}
 
 	defer db.Close()
 
-	// Initialise the router
-	r := mux.NewRouter()
+	repo = &sqlRepository{db: db, dialect: dbDialect}
 
-	// Unauthenticated endpoints
-	r.HandleFunc("/api/v1/login", loginUser).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/v1/register", registerUser).Methods("POST")
+	// Bring the schema up to date, the other commands only report on it and exit
+	if *migrateCommand != "up" {
+		if err := runMigrateCommand(db, *migrateCommand, dbDialect.Name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	auth := r.PathPrefix("/api/v1").Subrouter()
+	applied, err := migrate.Up(db, dbDialect.Name)
+	for _, migration := range applied {
+		log.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+	}
+	if err != nil {
+		panic(err.Error())
+	}
 
-	auth.HandleFunc("/users/self", getUser).Methods("GET", "OPTIONS")
-	auth.HandleFunc("/users/{userid}", getUserById).Methods("GET", "OPTIONS")
-	auth.HandleFunc("/users", getAllAccessibleUsers).Methods("GET", "OPTIONS")
+	// Initialise the attachment store
+	if ATTACHMENT_DIR == "" {
+		ATTACHMENT_DIR = "attachments"
+	}
 
-	auth.HandleFunc("/tasks", getTasks).Methods("GET", "OPTIONS")
-	auth.HandleFunc("/tasks", createTask).Methods("POST", "OPTIONS")
-	auth.HandleFunc("/tasks", updateTask).Methods("PUT", "OPTIONS")
-	auth.HandleFunc("/tasks", deleteTask).Methods("DELETE", "OPTIONS")
+	blobs, err = storage.NewLocalStore(ATTACHMENT_DIR)
+	if err != nil {
+		panic(err.Error())
+	}
 
-	r.Use(corsMiddleware)
-	auth.Use(authMiddleware)
+	// The handlers go through the services
+	useServices(newService(repo, blobs))
+
+	// Start materialising recurring tasks in the background
+	if SCHEDULE_TIMEZONE != "" {
+		scheduleLocation, err = time.LoadLocation(SCHEDULE_TIMEZONE)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	go runScheduler(time.Minute)
+
+	r := newRouter()
 
 	fmt.Printf("All setup running, and available on port 8000")
 
 	log.Fatal(http.ListenAndServe(":8000", r))
 }
 
+// Serves every version of the API, the services have to be set up before it handles requests
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	// Every version of the API serves the same endpoints, only the shape of some responses differs (see apiVersion)
+	for _, version := range apiVersions {
+		// Unauthenticated endpoints
+		r.HandleFunc("/api/"+version+"/login", loginUser).Methods("POST", "OPTIONS")
+		r.HandleFunc("/api/"+version+"/register", registerUser).Methods("POST")
+		r.HandleFunc("/api/"+version+"/token/refresh", refreshToken).Methods("POST", "OPTIONS")
+		r.HandleFunc("/api/"+version+"/logout", logoutUser).Methods("POST", "OPTIONS")
+
+		auth := r.PathPrefix("/api/" + version).Subrouter()
+
+		auth.HandleFunc("/users/self", getUser).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/users/{userid}", getUserById).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/users/{userid}", updateUser).Methods("PUT", "PATCH", "OPTIONS")
+		auth.HandleFunc("/users/{userid}", deactivateUser).Methods("DELETE", "OPTIONS")
+		auth.HandleFunc("/users/{userid}/tasks", getUserTasks).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/users", getAllAccessibleUsers).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/users", createUser).Methods("POST", "OPTIONS")
+
+		auth.HandleFunc("/invites", getInvites).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/invites", createInvite).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/invites/{code}", deleteInvite).Methods("DELETE", "OPTIONS")
+
+		auth.HandleFunc("/templates", getTemplates).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/templates", createTemplate).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/templates/{templateid}", deleteTemplate).Methods("DELETE", "OPTIONS")
+
+		auth.HandleFunc("/schedules", getSchedules).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/schedules", createSchedule).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/schedules/{scheduleid}", deleteSchedule).Methods("DELETE", "OPTIONS")
+
+		auth.HandleFunc("/units", getUnits).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/units", createUnit).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/units/{unitid}", updateUnit).Methods("PUT", "OPTIONS")
+
+		auth.HandleFunc("/tasks", getTasks).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/tasks", createTask).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/tasks/bulk", createTasks).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}", getTask).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}", updateTaskById).Methods("PUT", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}", patchTask).Methods("PATCH", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}", deleteTaskById).Methods("DELETE", "OPTIONS")
+		// Older clients name the task in the body, which gateways drop from DELETE requests
+		auth.HandleFunc("/tasks", deprecated(updateTask)).Methods("PUT", "OPTIONS")
+		auth.HandleFunc("/tasks", deprecated(deleteTask)).Methods("DELETE", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}/history", getTaskHistory).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}/comments", getTaskComments).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}/comments", createTaskComment).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}/attachments", getTaskAttachments).Methods("GET", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}/attachments", uploadTaskAttachment).Methods("POST", "OPTIONS")
+		auth.HandleFunc("/tasks/{taskid}/attachments/{attachmentid}", downloadTaskAttachment).Methods("GET", "OPTIONS")
+
+		auth.HandleFunc("/audit", getAuditFeed).Methods("GET", "OPTIONS")
+
+		auth.Use(authMiddleware)
+	}
+
+	r.Use(corsMiddleware)
+
+	return r
+}
+
+func runMigrateCommand(db *sql.DB, command string, dialect string) error {
+	switch command {
+	case "status":
+		status, err := migrate.GetStatus(db, dialect)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+	case "dry-run":
+		pending, err := migrate.Pending(db, dialect)
+		if err != nil {
+			return err
+		}
+
+		if len(pending) == 0 {
+			fmt.Println("The schema is up to date")
+		}
+
+		for _, migration := range pending {
+			fmt.Printf("-- %04d_%s\n%s\n", migration.Version, migration.Name, migration.SQL)
+		}
+	case "baseline":
+		// Databases created by hand from define.sql match one of the migrations
+		migration, err := migrate.Baseline(db, dialect)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Marked the migrations up to %04d_%s as applied\n", migration.Version, migration.Name)
+	default:
+		return fmt.Errorf("Unknown migrate command %q", command)
+	}
+
+	return nil
+}
+
+// Version 2 gives the users of a task as objects instead of names
+var apiVersions = []string{"v1", "v2"}
+
+// Reads the version of the API a request was made to, from its /api/{version}/ path prefix
+func apiVersion(r *http.Request) string {
+	for _, version := range apiVersions {
+		if strings.HasPrefix(r.URL.Path, "/api/"+version+"/") {
+			return version
+		}
+	}
+
+	return apiVersions[0]
+}
+
 //---------------------- MIDDLEWARES ------------------------------//
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Deprecation, Link")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(200)
@@ -79,19 +248,34 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// Marks the responses of a route that is only kept for older clients, the handler links to its successor
+func deprecated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		next(w, r)
+	}
+}
+
+// Points the client of a deprecated task route at the route that replaces it, once the task is known
+func setSuccessorLink(w http.ResponseWriter, r *http.Request, taskid string) {
+	if taskid != "" {
+		w.Header().Set("Link", "</api/"+apiVersion(r)+"/tasks/"+taskid+">; rel=\"successor-version\"")
+	}
+}
+
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		reqToken := r.Header.Get("Authorization")
 
 		if reqToken == "" {
-			http.Error(w, "No auth token", http.StatusForbidden)
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "No auth token"))
 			return
 		}
 
 		splitToken := strings.Split(reqToken, "Bearer")
 
 		if len(splitToken) != 2 {
-			http.Error(w, "Malformed format for auth token", http.StatusForbidden)
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "Malformed format for auth token"))
 			return
 		}
 
@@ -106,34 +290,77 @@ func authMiddleware(next http.Handler) http.Handler {
 			return []byte(JWT_SECRET), nil
 		})
 
+		// Expired tokens get a distinct status so that clients know to refresh them
+		if verr, ok := err.(*jwt.ValidationError); ok && verr.Errors&jwt.ValidationErrorExpired != 0 {
+			writeError(w, r, newError(http.StatusUnauthorized, codeTokenExpired, "Auth token expired"))
+			return
+		}
+
 		// Invalid JWT secret error
 		if err != nil {
-			http.Error(w, "Authentication failed", http.StatusForbidden)
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "Authentication failed"))
 			return
 		}
 
 		// Parsing the claims in the JWT token
 		if claims, ok := parsedToken.Claims.(jwt.MapClaims); ok && parsedToken.Valid {
-			// If the claims doesn't include the Id or the UserType, throw an error
-			if claims["id"] == nil || claims["type"] == nil {
-				http.Error(w, "Authentication claims failed", http.StatusForbidden)
+			// If the claims doesn't include the Id, the UserType or an expiry, throw an error
+			uid, ok := claims["id"].(string)
+			if !ok || claims["type"] == nil || claims["exp"] == nil {
+				writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "Authentication claims failed"))
 				return
 			}
 
-			uid := claims["id"].(string)
-			utype := claims["type"].(string)
+			// The type claim is not trusted, the role is always taken from the user table
+			user, err := loadPrincipal(uid)
+			if err != nil {
+				writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "Authentication failed"))
+				return
+			}
 
-			r.Header.Set("X-User-Claim", uid)
-			r.Header.Set("X-User-Type", utype)
+			// Deactivated accounts lose access straight away, even with a valid token
+			if !user.Active {
+				writeError(w, r, forbidden("Account is deactivated"))
+				return
+			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, user)))
 		} else {
-			http.Error(w, "Auth token invalid", http.StatusForbidden)
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "Auth token invalid"))
 			return
 		}
 	})
 }
 
+//------------------------------ PRINCIPAL -----------------------------------------//
+// The user making a request, as loaded by the authentication middleware
+type principal struct {
+	Id     string
+	Type   string
+	Active bool
+}
+
+type contextKey string
+
+const principalKey contextKey = "principal"
+
+// Loaded on every request rather than cached, so that a demotion or deactivation applies
+// to the very next request, on whichever server sharing the database receives it
+func loadPrincipal(uid string) (principal, error) {
+	details, err := repo.GetUser(uid)
+	if err != nil {
+		return principal{Id: uid}, err
+	}
+
+	return principal{Id: uid, Type: details.Utype, Active: details.Active}, nil
+}
+
+// Returns the authenticated user of the request, which is empty for routes outside the auth middleware
+func getPrincipal(r *http.Request) principal {
+	user, _ := r.Context().Value(principalKey).(principal)
+	return user
+}
+
 //------------------------------ HANDLERS (Login) ----------------------------------//
 // These handlers specifically bypass the authentication middleware, because they do not need any verification
 type loginUserRequest struct {
@@ -142,19 +369,24 @@ type loginUserRequest struct {
 }
 
 type loginUserResponse struct {
-	Jwt  string `json:"jwt"`
-	Type string `json:"type"`
-	Id   string `json:"id"`
+	Jwt          string    `json:"jwt"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	Type         string    `json:"type"`
+	Id           string    `json:"id"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
+// The type and unit are ignored on registration, they are taken from the invite instead
 type registerUserRequest struct {
+	Invite    string `json:"invite"`
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	Type      string `json:"type"`
-	Amb       int    `json:"amb"`
-	Depot     int    `json:"depot"`
-	Platoon   int    `json:"platoon"`
-	Section   int    `json:"section"`
+	Unit      string `json:"unit"`
 	Man       int    `json:"man"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
@@ -163,97 +395,99 @@ type registerUserRequest struct {
 
 func loginUser(w http.ResponseWriter, r *http.Request) {
 	var req loginUserRequest
-	var response loginUserResponse
 
 	// Decode the request
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := decodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	var uid string
-	var passwordhash string
-	var utype string
-
-	// Get the user associated to the username if it exists
-	sql := `SELECT user, password_hash, type FROM user WHERE username = ?`
-	if err := db.QueryRow(sql, req.Username).Scan(&uid, &passwordhash, &utype); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	response, err := sessionService.Login(req)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// Check if password hashes match then generate JWT
-	if CheckPasswordHash(req.Password, passwordhash) {
-		token, err := createJWT(uid, utype, JWT_SECRET)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response.Jwt = token
-		response.Type = utype
-		response.Id = uid
-
-		res, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		w.Write(res)
-	} else {
-		// Password incorrect, throw unauthorized error
-		http.Error(w, "Incorrect password", http.StatusUnauthorized)
+	res, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+
+	w.Write(res)
 }
 
 func registerUser(w http.ResponseWriter, r *http.Request) {
 	var req registerUserRequest
 
 	// Decode the request
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := decodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	// Generate unique uid
-	uid := shortuuid.New()
+	// Return the new JWT
+	response, err := sessionService.Register(req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	// Create the SQL prepared statement
-	sql := `INSERT INTO user VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-	stmt, err := db.Prepare(sql)
+	res, err := json.Marshal(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	//The existence of the actual content of the parsed request does not need to be checked as it is verified by the NOT NULL constraints
+	w.Write(res)
+}
+
+// Exchanges a refresh token for a new access token and a new refresh token.
+// Every refresh token can only be used once, presenting one again revokes all sessions of the user.
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
 
-	// Generate the password hash
-	passwordhash, err := HashPassword(req.Password)
+	// Decode the request
+	err := decodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// Execute the statement
-	_, err = stmt.Exec(uid, req.Username, passwordhash, req.Type, req.Amb, req.Depot, req.Platoon, req.Section, req.Man, req.Rank, req.FirstName, req.LastName)
+	response, err := sessionService.Refresh(req.RefreshToken)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// Return the new JWT
-	token, err := createJWT(uid, req.Type, JWT_SECRET)
+	res, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Ends a session by revoking its refresh token, the access token runs out on its own shortly after
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	if err := sessionService.Logout(req.RefreshToken); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write([]byte(token))
+	w.Write([]byte("Logged out successfully"))
 }
 
 //----------------------------- HANDLERS (User) ------------------------------------//
@@ -264,504 +498,1382 @@ type getUserResponse struct {
 	LastName  string `json:"last_name"`
 	Rank      string `json:"rank"`
 	Utype     string `json:"type"`
+	Unit      string `json:"unit"`
+	Man       int    `json:"man"`
+	Active    bool   `json:"active"`
 }
 
-func getUser(w http.ResponseWriter, r *http.Request) {
-	// Get the current user id
-	uid := r.Header.Get("X-User-Claim")
-
-	var res getUserResponse
+// Profile fields are replaced as a whole with PUT, the password and active state only change when given
+type updateUserRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Type      string `json:"type"`
+	Unit      string `json:"unit"`
+	Man       int    `json:"man"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Rank      string `json:"rank"`
+	Active    *bool  `json:"active"`
+}
 
-	// Get the user associated to the id if it exists
-	sql := `SELECT user, username, type, first_name, last_name, rank FROM user WHERE user = ?`
-	if err := db.QueryRow(sql, uid).Scan(&res.Id, &res.Username, &res.Utype, &res.FirstName, &res.LastName, &res.Rank); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+func getUser(w http.ResponseWriter, r *http.Request) {
+	// Get the user associated to the current user id if it exists
+	user, err := userService.Self(getPrincipal(r))
+	if err != nil {
+		writeError(w, r, orNotFound(err, "User not found"))
 		return
 	}
 
 	// Marshal to JSON and return
-	dres, err := json.Marshal(res)
+	res, err := json.Marshal(newUserResponse(user))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write(dres)
+	w.Write(res)
 }
 
 func getUserById(w http.ResponseWriter, r *http.Request) {
-	// Get the current user id
-	utype := r.Header.Get("X-User-Type")
-
-	if utype != "admin" {
-		http.Error(w, "No admin permissions for this user", http.StatusForbidden)
-		return
-	}
-
 	// Extract mux Vars
 	vars := mux.Vars(r)
 	if vars["userid"] == "" {
-		http.Error(w, "No user specifed", http.StatusBadRequest)
+		writeError(w, r, invalidRequest(errors.New("No user specifed")))
+		return
 	}
 
-	var res getUserResponse
-
-	// Get the user associated to the id if it exists
-	sql := `SELECT user, username, type, first_name, last_name, rank FROM user WHERE user = ?`
-	if err := db.QueryRow(sql, vars["userid"]).Scan(&res.Id, &res.Username, &res.Utype, &res.FirstName, &res.LastName, &res.Rank); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Get the user associated to the id if it falls under the admin user
+	user, err := userService.GetUser(getPrincipal(r), vars["userid"])
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	// Marshal to JSON and return
-	dres, err := json.Marshal(res)
+	res, err := json.Marshal(newUserResponse(user))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write(dres)
+	w.Write(res)
 }
 
+// Lists the normal users under the admin one page at a time. Takes the limit, cursor, sort (username, name, rank or unit,
+// prefixed with a minus for descending order), q (searching the username and names) and include_inactive query parameters
 func getAllAccessibleUsers(w http.ResponseWriter, r *http.Request) {
-	uid := r.Header.Get("X-User-Claim")
-	utype := r.Header.Get("X-User-Type")
-
-	if utype != "admin" {
-		http.Error(w, "No admin permissions for this user", http.StatusForbidden)
-		return
-	}
-
-	// Get the platoon and section of the admin user
-	amb, depot, platoon, section, err := getUserPrivileges(uid)
+	page, err := parsePage(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, invalidRequest(err))
 		return
 	}
 
-	var users []getUserResponse
+	query := r.URL.Query()
+	filter := userFilter{Sort: "username", Search: strings.TrimSpace(query.Get("q"))}
+
+	if order := query.Get("sort"); order != "" {
+		filter.Descending = strings.HasPrefix(order, "-")
+		filter.Sort = strings.TrimPrefix(order, "-")
+	}
 
-	// Get all the users under the admin user
-	sql := `SELECT user, username, type, first_name, last_name, rank FROM user WHERE type = "normal" AND `
-	addAdminFilters(&sql, amb, depot, platoon, section)
+	// Deactivated users are left out unless they are asked for
+	filter.IncludeInactive, _ = strconv.ParseBool(query.Get("include_inactive"))
 
-	result, err := db.Query(sql)
+	users, total, next, err := userService.ListUsers(getPrincipal(r), filter, page)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	defer result.Close()
-
-	for result.Next() {
-		var user getUserResponse
-		if err := result.Scan(&user.Id, &user.Username, &user.Utype, &user.FirstName, &user.LastName, &user.Rank); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		users = append(users, user)
+	items := []getUserResponse{}
+	for _, user := range users {
+		items = append(items, newUserResponse(user))
 	}
 
 	// Marshal to JSON and return
-	res, err := json.Marshal(users)
+	res, err := json.Marshal(pageResponse{Items: items, Total: total, NextCursor: next})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	w.Write(res)
 }
 
-//---------------------------- HANDLERS (Task) ------------------------------------//
-func getTasks(w http.ResponseWriter, r *http.Request) {
-	uid := r.Header.Get("X-User-Claim")
-	utype := r.Header.Get("X-User-Type")
-
-	var tasks []models.Task
-
-	if utype == "normal" {
-		// Get all the tasks under this user
-		sql := `SELECT task, name, assigned_to, assigned_by, completed, verified, verified_by FROM task WHERE assigned_to = ?`
-
-		results, err := db.Query(sql, uid)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		defer results.Close()
+func createUser(w http.ResponseWriter, r *http.Request) {
+	var req registerUserRequest
 
-		for results.Next() {
-			var task models.Task
-			if err := results.Scan(&task.Id, &task.Name, &task.AssignedTo, &task.AssignedBy, &task.Completed, &task.Verified, &task.VerifiedBy); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			var assignRank, assignFirstName, assignLastName string
+	user, err := userService.CreateUser(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			// Getting the assigned_by
-			sql = `SELECT rank, first_name, last_name FROM user WHERE user = ?`
-			if err := db.QueryRow(sql, task.AssignedBy).Scan(&assignRank, &assignFirstName, &assignLastName); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Marshal to JSON and return
+	res, err := json.Marshal(newUserResponse(user))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			var verifiedRank, verifiedFirstName, verifiedLastName string
+	w.Write(res)
+}
 
-			// Getting the assigned_by
-			sql = `SELECT rank, first_name, last_name FROM user WHERE user = ?`
-			if err := db.QueryRow(sql, task.VerifiedBy).Scan(&verifiedRank, &verifiedFirstName, &verifiedLastName); err != nil {
-				// Do nothing
-			}
+// Handles both PUT and PATCH, a PATCH only changes the fields present in the request
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	actor := getPrincipal(r)
 
-			task.AssignedBy = fmt.Sprintf("%s %s %s", assignRank, assignFirstName, assignLastName)
-			task.VerifiedBy = fmt.Sprintf("%s %s %s", verifiedRank, verifiedFirstName, verifiedLastName)
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["userid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No user specifed")))
+		return
+	}
 
-			tasks = append(tasks, task)
-		}
-	} else if utype == "admin" {
-		// Get the platoon and section of the admin user
-		amb, depot, platoon, section, err := getUserPrivileges(uid)
+	var req updateUserRequest
+	if r.Method == "PATCH" {
+		user, err := userService.GetUser(actor, vars["userid"])
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 
-		// Get all the tasks under this admin
-		sql := `SELECT task.task, task.name, task.assigned_to, task.assigned_by, task.completed, task.verified, task.verified_by
-		FROM task INNER JOIN user ON user.user = task.assigned_to 
-		WHERE type = "normal" AND `
-		addAdminFilters(&sql, amb, depot, platoon, section)
-
-		results, err := db.Query(sql, platoon, section)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		req = updateUserRequest{
+			Username:  user.Username,
+			Type:      user.Utype,
+			Unit:      user.Unit,
+			Man:       user.Man,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Rank:      user.Rank,
 		}
+	}
 
-		defer results.Close()
-
-		for results.Next() {
-			var task models.Task
-			if err := results.Scan(&task.Id, &task.Name, &task.AssignedTo, &task.AssignedBy, &task.Completed, &task.Verified, &task.VerifiedBy); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			var assignRank, assignFirstName, assignLastName string
-
-			// Getting the assigned_by
-			sql = `SELECT rank, first_name, last_name FROM user WHERE user = ?`
-			if err := db.QueryRow(sql, task.AssignedBy).Scan(&assignRank, &assignFirstName, &assignLastName); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			var verifiedRank, verifiedFirstName, verifiedLastName string
-
-			// Getting the assigned_by
-			sql = `SELECT rank, first_name, last_name FROM user WHERE user = ?`
-			if err := db.QueryRow(sql, task.VerifiedBy).Scan(&verifiedRank, &verifiedFirstName, &verifiedLastName); err != nil {
-				// Do nothing
-			}
-
-			task.AssignedBy = fmt.Sprintf("%s %s %s", assignRank, assignFirstName, assignLastName)
-			task.VerifiedBy = fmt.Sprintf("%s %s %s", verifiedRank, verifiedFirstName, verifiedLastName)
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			tasks = append(tasks, task)
-		}
+	user, err := userService.UpdateUser(actor, vars["userid"], req)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
 
-	// Return the full task list
 	// Marshal to JSON and return
-	res, err := json.Marshal(tasks)
+	res, err := json.Marshal(newUserResponse(user))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	w.Write(res)
 }
 
-type createTaskRequest struct {
-	Name       string `json:"name"`
-	AssignedTo string `json:"assigned_to"`
-}
-
-func createTask(w http.ResponseWriter, r *http.Request) {
-	// Check the admin privileges
-	uid := r.Header.Get("X-User-Claim")
-	utype := r.Header.Get("X-User-Type")
-
-	if utype != "admin" {
-		http.Error(w, "No admin permissions for this user", http.StatusForbidden)
+// Users are never removed so that their tasks and history stay intact, they are deactivated instead
+func deactivateUser(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["userid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No user specifed")))
 		return
 	}
 
-	// Get the platoon and section of the admin user
-	aamb, adepot, aplatoon, asection, err := getUserPrivileges(uid)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := userService.DeactivateUser(getPrincipal(r), vars["userid"]); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	var req createTaskRequest
+	w.Write([]byte("Deactivated user successfully"))
+}
 
-	// Decode the request
-	err = json.NewDecoder(r.Body).Decode(&req)
+//---------------------------- HANDLERS (Invite) ----------------------------------//
+type createInviteRequest struct {
+	Type      string `json:"type"`
+	Unit      string `json:"unit"`
+	ExpiresIn int    `json:"expires_in_days"`
+}
+
+func getInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := unitService.ListInvites(getPrincipal(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	uamb, udepot, uplatoon, usection, err := getUserPrivileges(req.AssignedTo)
-
-	// Check if admin has enough privileges to assign tasks to this user
-	if aamb == uamb &&
-		(adepot == udepot || adepot == -1) &&
-		(aplatoon == uplatoon || aplatoon == -1) &&
-		(asection == usection || asection == -1) {
-		// Create the task
-		tuid := shortuuid.New()
-
-		// Create the SQL prepared statement
-		sql := `INSERT INTO task VALUES (?, ?, ?, ?, ?, ?, "")`
-		stmt, err := db.Prepare(sql)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Execute the statement
-		_, err = stmt.Exec(tuid, req.Name, req.AssignedTo, uid, false, false)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		http.Error(w, "Insufficient admin permissions for this user", http.StatusForbidden)
+	// Marshal to JSON and return
+	res, err := json.Marshal(invites)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write([]byte("Created task successfully"))
-}
-
-type deleteTaskRequest struct {
-	Id string `json:"id"`
+	w.Write(res)
 }
 
-func deleteTask(w http.ResponseWriter, r *http.Request) {
-	// Check the admin privileges
-	uid := r.Header.Get("X-User-Claim")
-	utype := r.Header.Get("X-User-Type")
+func createInvite(w http.ResponseWriter, r *http.Request) {
+	var req createInviteRequest
 
-	if utype != "admin" {
-		http.Error(w, "No admin permissions for this user", http.StatusForbidden)
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// Get the platoon and section of the admin user
-	aamb, adepot, aplatoon, asection, err := getUserPrivileges(uid)
+	invite, err := unitService.CreateInvite(getPrincipal(r), req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	var req deleteTaskRequest
-	var task models.Task
-
-	// Decode the request
-	err = json.NewDecoder(r.Body).Decode(&req)
+	// Marshal to JSON and return
+	res, err := json.Marshal(invite)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	// Retrive the task information
-	sql := `SELECT * FROM task WHERE task = ?`
-	if err := db.QueryRow(sql, req.Id).Scan(&task.Id, &task.Name, &task.AssignedTo, &task.AssignedBy, &task.Completed, &task.Verified, &task.VerifiedBy); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	w.Write(res)
+}
+
+// Revokes an invite which has not been used yet
+func deleteInvite(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["code"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No invite specified")))
 		return
 	}
 
-	// Retrive assignee information
-	uamb, udepot, uplatoon, usection, err := getUserPrivileges(task.AssignedTo)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := unitService.DeleteInvite(getPrincipal(r), vars["code"]); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// Check if admin has enough privileges to remove tasks from this user
-	if aamb == uamb &&
-		(adepot == udepot || adepot == -1) &&
-		(aplatoon == uplatoon || aplatoon == -1) &&
-		(asection == usection || asection == -1) {
+	w.Write([]byte("Deleted invite successfully"))
+}
+
+//----------------------------- HANDLERS (Unit) ------------------------------------//
+// Every unit level can only be placed directly below the level before it
+var unitLevels = []string{"amb", "depot", "platoon", "section"}
+
+type unitRequest struct {
+	Name   string `json:"name"`
+	Level  string `json:"level"`
+	Parent string `json:"parent"`
+}
+
+func getUnits(w http.ResponseWriter, r *http.Request) {
+	units, err := unitService.ListUnits(getPrincipal(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(units)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+func createUnit(w http.ResponseWriter, r *http.Request) {
+	var req unitRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	unit, err := unitService.CreateUnit(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(unit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Renames a unit or moves it, along with everything below it, to a different parent
+func updateUnit(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["unitid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No unit specified")))
+		return
+	}
+
+	var req unitRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	unit, err := unitService.UpdateUnit(getPrincipal(r), vars["unitid"], req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(unit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+//---------------------------- HANDLERS (Task) ------------------------------------//
+// Lists the tasks visible to the user one page at a time, see parsePage and parseTaskFilter for the query parameters
+func getTasks(w http.ResponseWriter, r *http.Request) {
+	listTasks(w, r, "")
+}
+
+// Lists the tasks assigned to the user in the path, with the same filters as getTasks
+func getUserTasks(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["userid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No user specified")))
+		return
+	}
+
+	listTasks(w, r, vars["userid"])
+}
+
+// Writes a page of the tasks the principal can see, only those of user when one is given
+func listTasks(w http.ResponseWriter, r *http.Request, user string) {
+	// Parse the optional due date filters
+	due, err := parseDueFilter(r)
+	if err != nil {
+		writeError(w, r, invalidRequest(err))
+		return
+	}
+
+	// Parse the optional priority, category, tag and search filters and the sort order
+	filter, err := parseTaskFilter(r)
+	if err != nil {
+		writeError(w, r, invalidRequest(err))
+		return
+	}
+
+	page, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, invalidRequest(err))
+		return
+	}
+
+	var tasks []models.Task
+	var total int
+	var next string
+	if user == "" {
+		tasks, total, next, err = taskService.ListTasks(getPrincipal(r), due, filter, page)
+	} else {
+		tasks, total, next, err = taskService.ListUserTasks(getPrincipal(r), user, due, filter, page)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	res := pageResponse{Total: total, NextCursor: next}
+	if apiVersion(r) == "v1" {
+		// Version 1 clients show the assigner and verifier by name
+		for i := range tasks {
+			tasks[i].AssignedBy = formatUserRef(tasks[i].Assigner)
+			tasks[i].VerifiedBy = formatUserRef(tasks[i].Verifier)
+		}
+		res.Items = tasks
+	} else {
+		items := []taskResponse{}
+		for _, task := range tasks {
+			items = append(items, newTaskResponse(task))
+		}
+		res.Items = items
+	}
+
+	// Marshal to JSON and return
+	dres, err := json.Marshal(res)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// A task as given by version 2 of the API, with its users as objects and null for a missing verifier
+type taskResponse struct {
+	Id         string          `json:"id"`
+	Name       string          `json:"name"`
+	AssignedTo *models.UserRef `json:"assigned_to"`
+	AssignedBy *models.UserRef `json:"assigned_by"`
+	VerifiedBy *models.UserRef `json:"verified_by"`
+
+	Status          string `json:"status"`
+	RejectionReason string `json:"rejection_reason"`
+
+	Priority string   `json:"priority"`
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	DueAt       *time.Time `json:"due_at"`
+	SubmittedAt *time.Time `json:"submitted_at"`
+	VerifiedAt  *time.Time `json:"verified_at"`
+
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newTaskResponse(task models.Task) taskResponse {
+	return taskResponse{
+		Id:              task.Id,
+		Name:            task.Name,
+		AssignedTo:      task.Assignee,
+		AssignedBy:      task.Assigner,
+		VerifiedBy:      task.Verifier,
+		Status:          task.Status,
+		RejectionReason: task.RejectionReason,
+		Priority:        task.Priority,
+		Category:        task.Category,
+		Tags:            task.Tags,
+		CreatedAt:       task.CreatedAt,
+		DueAt:           task.DueAt,
+		SubmittedAt:     task.SubmittedAt,
+		VerifiedAt:      task.VerifiedAt,
+		Version:         task.Version,
+		UpdatedAt:       task.UpdatedAt,
+	}
+}
+
+// Shows a user as "Rank First Last", each part is left empty for a missing user
+func formatUserRef(user *models.UserRef) string {
+	if user == nil {
+		user = &models.UserRef{}
+	}
+
+	return fmt.Sprintf("%s %s %s", user.Rank, user.FirstName, user.LastName)
+}
+
+type createTaskRequest struct {
+	Name       string     `json:"name"`
+	AssignedTo string     `json:"assigned_to"`
+	DueAt      *time.Time `json:"due_at"`
+	Priority   string     `json:"priority"`
+	Category   string     `json:"category"`
+	Tags       []string   `json:"tags"`
+}
+
+func createTask(w http.ResponseWriter, r *http.Request) {
+	var req createTaskRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if _, err := taskService.CreateTask(getPrincipal(r), req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("Created task successfully"))
+}
+
+// Bulk assignments target either a list of users or every normal user within a unit
+type createTasksRequest struct {
+	Name       string     `json:"name"`
+	AssignedTo []string   `json:"assigned_to"`
+	Unit       string     `json:"unit"`
+	DueAt      *time.Time `json:"due_at"`
+	Priority   string     `json:"priority"`
+	Category   string     `json:"category"`
+	Tags       []string   `json:"tags"`
+}
+
+type createTasksResult struct {
+	AssignedTo string `json:"assigned_to"`
+	Task       string `json:"task,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Assigns the same task to many users at once. Every task is created in a single transaction,
+// users that cannot be assigned are skipped and reported in the per-user results.
+func createTasks(w http.ResponseWriter, r *http.Request) {
+	var req createTasksRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results, err := taskService.CreateTasks(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(results)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+type deleteTaskRequest struct {
+	Id string `json:"id"`
+}
+
+func deleteTask(w http.ResponseWriter, r *http.Request) {
+	var req deleteTaskRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setSuccessorLink(w, r, req.Id)
+
+	if err := taskService.DeleteTask(getPrincipal(r), req.Id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("Deleted task successfully"))
+}
+
+func deleteTaskById(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	if err := taskService.DeleteTask(getPrincipal(r), vars["taskid"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("Deleted task successfully"))
+}
+
+func getTask(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	task, err := taskService.GetTask(getPrincipal(r), vars["taskid"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeTask(w, r, task)
+}
+
+// The changes of a task update. Fields that are left out keep their value, and a due_at of null removes the
+// due date. The version, either in the body or from If-Match, makes the update conditional on it.
+type updateTaskRequest struct {
+	Id              string       `json:"id"`
+	Name            *string      `json:"name"`
+	AssignedTo      *string      `json:"assigned_to"`
+	Status          *string      `json:"status"`
+	RejectionReason *string      `json:"rejection_reason"`
+	DueAt           optionalTime `json:"due_at"`
+	Priority        *string      `json:"priority"`
+	Category        *string      `json:"category"`
+	Tags            []string     `json:"tags"`
+	Version         int          `json:"version"`
+
+	readOnlyTaskFields
+}
+
+// Fields of a task that follow from the workflow and the users behind it. They are read back, but an update
+// sending them is refused rather than having them silently ignored.
+type readOnlyTaskFields struct {
+	AssignedBy  json.RawMessage `json:"assigned_by"`
+	VerifiedBy  json.RawMessage `json:"verified_by"`
+	CreatedAt   json.RawMessage `json:"created_at"`
+	SubmittedAt json.RawMessage `json:"submitted_at"`
+	VerifiedAt  json.RawMessage `json:"verified_at"`
+	UpdatedAt   json.RawMessage `json:"updated_at"`
+	Assignee    json.RawMessage `json:"assignee"`
+	Assigner    json.RawMessage `json:"assigner"`
+	Verifier    json.RawMessage `json:"verifier"`
+}
+
+// A time that an update can leave out, set, or clear with null
+type optionalTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (t *optionalTime) UnmarshalJSON(data []byte) error {
+	t.Set = true
+	return json.Unmarshal(data, &t.Value)
+}
+
+// Version 1 clients replace a task with the object they have read, fields it holds that cannot be updated are
+// ignored. Clients that don't know about due dates, priorities, categories and tags leave them empty, which
+// keeps them as they are.
+func legacyTaskUpdate(task models.Task) updateTaskRequest {
+	req := updateTaskRequest{
+		Id:              task.Id,
+		Name:            &task.Name,
+		AssignedTo:      &task.AssignedTo,
+		Status:          &task.Status,
+		RejectionReason: &task.RejectionReason,
+		DueAt:           optionalTime{Set: task.DueAt != nil, Value: task.DueAt},
+		Tags:            task.Tags,
+		Version:         task.Version,
+	}
+
+	if task.Priority != "" {
+		req.Priority = &task.Priority
+	}
+
+	if strings.TrimSpace(task.Category) != "" {
+		req.Category = &task.Category
+	}
+
+	return req
+}
+
+// Replaces the task given in the body. A version in the body or an If-Match header makes the update
+// conditional, it is refused with 412 once the task has moved past that version.
+func updateTask(w http.ResponseWriter, r *http.Request) {
+	var task models.Task
+
+	// Decode the request
+	err := decodeJSON(w, r, &task)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setSuccessorLink(w, r, task.Id)
+
+	req := legacyTaskUpdate(task)
+	if err := req.validateReplacement(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if !applyIfMatch(r, &req.Version) {
+		writeError(w, r, preconditionFailed("If-Match does not name a version of the task"))
+		return
+	}
+
+	updated, err := taskService.UpdateTask(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", taskETag(updated))
+	w.Write([]byte("Task updated successfully"))
+}
+
+// Replaces the task in the path and returns it, under the same conditions as updateTask. The name, assignee
+// and status are required, the other fields are kept when they are left out. The body may leave out the id,
+// but it cannot name another task.
+func updateTaskById(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	var req updateTaskRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if req.Id == "" {
+		req.Id = vars["taskid"]
+	}
+
+	if req.Id != vars["taskid"] {
+		writeError(w, r, invalid("The id of a task cannot be changed"))
+		return
+	}
+
+	if err := req.validateReplacement(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if !applyIfMatch(r, &req.Version) {
+		writeError(w, r, preconditionFailed("If-Match does not name a version of the task"))
+		return
+	}
+
+	task, err := taskService.UpdateTask(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeTask(w, r, task)
+}
+
+// Changes only the fields present in the request and returns the updated task. The changes are applied to the
+// version of the task read by the service unless the request names another one, either in its body or with If-Match.
+func patchTask(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	var req updateTaskRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if req.Id == "" {
+		req.Id = vars["taskid"]
+	}
+
+	if req.Id != vars["taskid"] {
+		writeError(w, r, invalid("The id of a task cannot be changed"))
+		return
+	}
+
+	if !applyIfMatch(r, &req.Version) {
+		writeError(w, r, preconditionFailed("If-Match does not name a version of the task"))
+		return
+	}
+
+	task, err := taskService.UpdateTask(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeTask(w, r, task)
+}
+
+// Tasks are tagged with their version, which changes on every update
+func taskETag(task models.Task) string {
+	return `"` + strconv.Itoa(task.Version) + `"`
+}
+
+// Makes the update conditional on the version named by an If-Match header. A missing header or * leaves
+// the update as it is, false is returned for anything but a single ETag of a task since it can never match.
+func applyIfMatch(r *http.Request, version *int) bool {
+	match := strings.TrimSpace(r.Header.Get("If-Match"))
+	if match == "" || match == "*" {
+		return true
+	}
+
+	if len(match) < 2 || !strings.HasPrefix(match, `"`) || !strings.HasSuffix(match, `"`) {
+		return false
+	}
+
+	v, err := strconv.Atoi(match[1 : len(match)-1])
+	if err != nil || v < 1 {
+		return false
+	}
 
-		// Create the SQL prepared statement
-		sql := `DELETE FROM task WHERE task = ?`
-		stmt, err := db.Prepare(sql)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	*version = v
+	return true
+}
 
-		// Execute the statement
-		_, err = stmt.Exec(task.Id)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		http.Error(w, "Insufficient admin permissions for this user", http.StatusForbidden)
+// Writes a single task in the format of the API version along with its ETag
+func writeTask(w http.ResponseWriter, r *http.Request, task models.Task) {
+	var res interface{} = newTaskResponse(task)
+	if apiVersion(r) == "v1" {
+		// Version 1 clients show the assigner and verifier by name
+		task.AssignedBy = formatUserRef(task.Assigner)
+		task.VerifiedBy = formatUserRef(task.Verifier)
+		res = task
+	}
+
+	// Marshal to JSON and return
+	dres, err := json.Marshal(res)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write([]byte("Deleted task successfully"))
+	w.Header().Set("ETag", taskETag(task))
+	w.Write(dres)
+}
 
+//---------------------------- HANDLERS (Comment) ---------------------------------//
+type createCommentRequest struct {
+	Body string `json:"body"`
 }
 
-func updateTask(w http.ResponseWriter, r *http.Request) {
-	var req models.Task
-	var task models.Task
+func getTaskComments(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	comments, err := taskService.ListComments(getPrincipal(r), vars["taskid"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(comments)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+func createTaskComment(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	var req createCommentRequest
 
 	// Decode the request
-	err = json.NewDecoder(r.Body).Decode(&req)
+	err := decodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	// Retrive the task information
-	sql := `SELECT * FROM task WHERE task = ?`
-	if err := db.QueryRow(sql, req.Id).Scan(&task.Id, &task.Name, &task.AssignedTo, &task.AssignedBy, &task.Completed, &task.Verified, &task.VerifiedBy); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	comment, err := taskService.CreateComment(getPrincipal(r), vars["taskid"], req)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// Check privilege of accessing request
-	uid := r.Header.Get("X-User-Claim")
-	utype := r.Header.Get("X-User-Type")
+	// Marshal to JSON and return
+	res, err := json.Marshal(comment)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	if utype == "normal" {
-		if uid != task.AssignedTo {
-			http.Error(w, "This user doesn't have admin permissions", http.StatusForbidden)
-			return
-		}
+	w.Write(res)
+}
 
-		// Normal user doesn't have access to update these fields
-		if req.Id != task.Id || req.Name != task.Name || req.AssignedTo != task.AssignedTo || req.Verified != task.Verified {
-			http.Error(w, "This user doesn't have permissions to update these fields", http.StatusForbidden)
-			return
+//--------------------------- HANDLERS (Attachment) -------------------------------//
+// Uploads are limited to photos and PDFs of at most 10MB
+const maxAttachmentSize = 10 << 20
+
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+func getTaskAttachments(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	attachments, err := taskService.ListAttachments(getPrincipal(r), vars["taskid"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(attachments)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Accepts a multipart form with the file in the "file" field
+func uploadTaskAttachment(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	// The form is only parsed once the service has checked the access to the task
+	var file multipart.File
+	defer func() {
+		if file != nil {
+			file.Close()
 		}
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+		}
+	}()
 
-		task.Completed = req.Completed
-	} else if utype == "admin" {
-		// Check if admin user has access to this task assignee
-		aamb, adepot, aplatoon, asection, err := getUserPrivileges(uid)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	attachment, err := taskService.CreateAttachment(getPrincipal(r), vars["taskid"], func() (attachmentUpload, error) {
+		// Leave some room for the multipart headers around the file
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+(1<<20))
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			return attachmentUpload{}, invalid("Attachment is too large or malformed")
 		}
-		// Retrive assignee information
-		uamb, udepot, uplatoon, usection, err := getUserPrivileges(task.AssignedTo)
+
+		f, header, err := r.FormFile("file")
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return attachmentUpload{}, invalidRequest(err)
 		}
 
-		// Check if admin has enough privileges to update tasks from this user
-		if aamb == uamb &&
-			(adepot == udepot || adepot == -1) &&
-			(aplatoon == uplatoon || aplatoon == -1) &&
-			(asection == usection || asection == -1) {
+		file = f
+		return attachmentUpload{Filename: filepath.Base(header.Filename), Size: header.Size, Content: f}, nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			task.Name = req.Name
-			task.AssignedTo = req.AssignedTo
-			// task.AssignedBy = req.AssignedBy
-			task.Completed = req.Completed
-			task.Verified = req.Verified
+	// Marshal to JSON and return
+	res, err := json.Marshal(attachment)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			if req.Verified == true && task.Verified == false {
-				task.VerifiedBy = uid
-			} else if req.Verified == false && task.Verified == true {
-				task.VerifiedBy = ""
-			}
+	w.Write(res)
+}
 
-		} else {
-			http.Error(w, "This user doesn't have admin permissions", http.StatusForbidden)
+func downloadTaskAttachment(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" || vars["attachmentid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No attachment specified")))
+		return
+	}
+
+	attachment, blob, err := taskService.GetAttachment(getPrincipal(r), vars["taskid"], vars["attachmentid"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	io.Copy(w, blob)
+}
+
+//--------------------------- HANDLERS (Template) ---------------------------------//
+type createTemplateRequest struct {
+	Name      string `json:"name"`
+	DueInDays int    `json:"due_in_days"`
+}
+
+func getTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := scheduleService.ListTemplates(getPrincipal(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(templates)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Templates belong to the unit of the admin creating them
+func createTemplate(w http.ResponseWriter, r *http.Request) {
+	var req createTemplateRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	template, err := scheduleService.CreateTemplate(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(template)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Removes a template along with every schedule that was using it
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["templateid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No template specified")))
+		return
+	}
+
+	if err := scheduleService.DeleteTemplate(getPrincipal(r), vars["templateid"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("Deleted template successfully"))
+}
+
+//--------------------------- HANDLERS (Schedule) ---------------------------------//
+// A schedule targets either a single user or every normal user within a unit
+type createScheduleRequest struct {
+	Template   string `json:"template"`
+	Rule       string `json:"rule"`
+	AssignedTo string `json:"assigned_to"`
+	Unit       string `json:"unit"`
+}
+
+func getSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := scheduleService.ListSchedules(getPrincipal(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(schedules)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var req createScheduleRequest
+
+	// Decode the request
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	schedule, err := scheduleService.CreateSchedule(getPrincipal(r), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(schedule)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+// Stops a schedule, it is kept so that its past runs can still be traced
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["scheduleid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No schedule specified")))
+		return
+	}
+
+	if err := scheduleService.StopSchedule(getPrincipal(r), vars["scheduleid"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("Stopped schedule successfully"))
+}
+
+//---------------------------- HANDLERS (History) ---------------------------------//
+func getTaskHistory(w http.ResponseWriter, r *http.Request) {
+	// Extract mux Vars
+	vars := mux.Vars(r)
+	if vars["taskid"] == "" {
+		writeError(w, r, invalidRequest(errors.New("No task specified")))
+		return
+	}
+
+	events, err := taskService.TaskHistory(getPrincipal(r), vars["taskid"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Marshal to JSON and return
+	res, err := json.Marshal(events)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+func getAuditFeed(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > 1000 {
+			writeError(w, r, invalidRequest(errors.New("Invalid value for limit")))
 			return
 		}
-	} else {
-		http.Error(w, "Unknown exception", http.StatusInternalServerError)
-		return
 	}
 
-	// Update the database with the task
-	sql = `UPDATE task SET name = ?, assigned_to = ?, assigned_by = ?, completed = ?, verified = ?, verified_by = ? WHERE task = ?`
-	stmt, err := db.Prepare(sql)
+	events, err := taskService.AuditFeed(getPrincipal(r), limit)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// Execute the statement
-	_, err = stmt.Exec(task.Name, task.AssignedTo, task.AssignedBy, task.Completed, task.Verified, task.VerifiedBy, task.Id)
+	// Marshal to JSON and return
+	res, err := json.Marshal(events)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write([]byte("Task updated successfully"))
+	w.Write(res)
+}
+
+//------------------------ SCHEDULER -----------------------------------------------//
+// Checks for due schedules for as long as the server runs
+func runScheduler(interval time.Duration) {
+	for {
+		if err := scheduleService.RunDueSchedules(time.Now().UTC()); err != nil {
+			log.Printf("Failed to run task schedules: %s", err)
+		}
+
+		time.Sleep(interval)
+	}
 }
 
 //------------------------ UTILITIES -----------------------------------------------//
-func createJWT(uid string, utype string, secret string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":   uid,
-		"type": utype,
-	})
-	tokenString, err := token.SignedString([]byte(secret))
+func newUserResponse(user models.User) getUserResponse {
+	return getUserResponse{
+		Id:        user.Id,
+		Username:  user.Username,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Rank:      user.Rank,
+		Utype:     user.Utype,
+		Unit:      user.Unit,
+		Man:       user.Man,
+		Active:    user.Active,
+	}
+}
 
-	return tokenString, err
+type dueFilter struct {
+	Overdue   bool
+	DueWithin int
 }
 
-func getUserPrivileges(uid string) (int, int, int, int, error) {
-	var amb int
-	var depot int
-	var platoon int
-	var section int
+// Reads the overdue and due_within (days) query parameters of a task listing
+func parseDueFilter(r *http.Request) (dueFilter, error) {
+	var filter dueFilter
+	query := r.URL.Query()
+
+	if overdue := query.Get("overdue"); overdue != "" {
+		v, err := strconv.ParseBool(overdue)
+		if err != nil {
+			return filter, errors.New("Invalid value for overdue")
+		}
+		filter.Overdue = v
+	}
+
+	if within := query.Get("due_within"); within != "" {
+		v, err := strconv.Atoi(within)
+		if err != nil || v < 0 {
+			return filter, errors.New("Invalid value for due_within")
+		}
+		filter.DueWithin = v
+	}
 
-	sql := `SELECT amb, depot, platoon, section FROM user WHERE user = ?`
-	if err := db.QueryRow(sql, uid).Scan(&amb, &depot, &platoon, &section); err != nil {
-		return amb, depot, platoon, section, err
+	if filter.Overdue && filter.DueWithin > 0 {
+		return filter, errors.New("Cannot filter on both overdue and due_within")
 	}
 
-	return amb, depot, platoon, section, nil
+	return filter, nil
+}
+
+type taskFilter struct {
+	AssignedTo string
+	Priorities []string
+	Category   string
+	Tags       []string
+	Search     string
+	Sort       string
+	Descending bool
 }
 
-func addAdminFilters(sql *string, amb int, depot int, platoon int, section int) {
-	*sql += fmt.Sprintf("amb = %d", amb)
-	if depot != -1 {
-		*sql += " AND "
-		*sql += fmt.Sprintf("depot = %d", depot)
+// Reads the assigned_to, priority (comma separated), category, tag (repeatable), q (search) and sort query parameters
+// of a task listing. Sorting on a column in descending order is done by prefixing it with a minus, e.g. sort=-priority
+func parseTaskFilter(r *http.Request) (taskFilter, error) {
+	filter := taskFilter{Sort: "created_at"}
+	query := r.URL.Query()
+
+	filter.AssignedTo = query.Get("assigned_to")
+	filter.Search = strings.TrimSpace(query.Get("q"))
+
+	if priority := query.Get("priority"); priority != "" {
+		for _, p := range strings.Split(priority, ",") {
+			if !validPriority(p) {
+				return filter, errors.New("Invalid value for priority")
+			}
+			filter.Priorities = append(filter.Priorities, p)
+		}
 	}
-	if platoon != -1 {
-		*sql += " AND "
-		*sql += fmt.Sprintf("platoon = %d", platoon)
+
+	filter.Category = strings.TrimSpace(query.Get("category"))
+
+	if tags, ok := query["tag"]; ok {
+		normalized, err := normalizeTags(tags)
+		if err != nil {
+			return filter, errors.New("Invalid value for tag")
+		}
+		filter.Tags = normalized
 	}
-	if section != -1 {
-		*sql += " AND "
-		*sql += fmt.Sprintf("section = %d", section)
+
+	if order := query.Get("sort"); order != "" {
+		filter.Descending = strings.HasPrefix(order, "-")
+		filter.Sort = strings.TrimPrefix(order, "-")
+		if _, ok := taskSortColumns[filter.Sort]; !ok {
+			return filter, errors.New("Invalid value for sort")
+		}
 	}
+
+	return filter, nil
+}
+
+type pageRequest struct {
+	Limit  int
+	Cursor *pageCursor
+}
+
+// Position of the last row of a page, the sort key of the row and its id to break ties
+type pageCursor struct {
+	Key string `json:"k"`
+	Id  string `json:"id"`
+}
+
+// Every paginated listing is wrapped the same way, next_cursor is left out on the last page
+type pageResponse struct {
+	Items      interface{} `json:"items"`
+	Total      int         `json:"total"`
+	NextCursor string      `json:"next_cursor,omitempty"`
 }
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
+const defaultPageLimit = 50
+const maxPageLimit = 200
+
+// Reads the limit and cursor query parameters of a listing, the cursor is the next_cursor of the previous page
+func parsePage(r *http.Request) (pageRequest, error) {
+	page := pageRequest{Limit: defaultPageLimit}
+	query := r.URL.Query()
+
+	if limit := query.Get("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v < 1 || v > maxPageLimit {
+			return page, fmt.Errorf("Invalid value for limit, it has to be between 1 and %d", maxPageLimit)
+		}
+		page.Limit = v
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		var c pageCursor
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(raw, &c) != nil {
+			return page, errors.New("Invalid value for cursor")
+		}
+		page.Cursor = &c
+	}
+
+	return page, nil
 }
 
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+func encodeCursor(cursor pageCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
 }
@@ -0,0 +1,929 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lithammer/shortuuid"
+
+	"server/models"
+)
+
+//------------------------ IN-MEMORY REPOSITORY ------------------------------------//
+// Keeps everything in maps so that the services and handlers can run without a database, such as in tests.
+// The search only looks at task names.
+type memoryRepository struct {
+	sync.Mutex
+	units        map[string]models.Unit
+	users        map[string]userCredentials
+	tasks        map[string]models.Task
+	comments     map[string][]models.Comment
+	attachments  map[string][]models.Attachment
+	events       []models.TaskEvent
+	invites      map[string]models.Invite
+	sessions     map[string]session
+	templates    map[string]models.Template
+	schedules    map[string]models.Schedule
+	scheduleRuns map[string]bool
+}
+
+var _ Repository = (*memoryRepository)(nil)
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		units:        map[string]models.Unit{},
+		users:        map[string]userCredentials{},
+		tasks:        map[string]models.Task{},
+		comments:     map[string][]models.Comment{},
+		attachments:  map[string][]models.Attachment{},
+		invites:      map[string]models.Invite{},
+		sessions:     map[string]session{},
+		templates:    map[string]models.Template{},
+		schedules:    map[string]models.Schedule{},
+		scheduleRuns: map[string]bool{},
+	}
+}
+
+// Whether the unit is the root unit or one of the units below it
+func (m *memoryRepository) inSubtree(unit string, root string) bool {
+	for i := 0; i <= len(m.units); i++ {
+		if unit == root {
+			return true
+		}
+
+		current, ok := m.units[unit]
+		if !ok || current.Parent == "" {
+			return false
+		}
+		unit = current.Parent
+	}
+
+	return false
+}
+
+func (m *memoryRepository) inScope(admin string, unit string) bool {
+	user, ok := m.users[admin]
+	return ok && user.Utype == "admin" && m.inSubtree(unit, user.Unit)
+}
+
+func (m *memoryRepository) usernameTaken(username string, uid string) bool {
+	for _, user := range m.users {
+		if user.Id != uid && strings.ToLower(user.Username) == username {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rows are ordered on their sort key with the id breaking ties, like addPage does in SQL
+type memoryRow struct {
+	key string
+	id  string
+}
+
+// Sorts the rows and reads those after the cursor into a page with read
+func memoryPage(rows []memoryRow, page pageRequest, descending bool, read func(id string)) pager {
+	less := func(a memoryRow, b memoryRow) bool {
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.id < b.id
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if descending {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+
+	p := pager{page: page, Total: len(rows)}
+	for _, row := range rows {
+		if page.Cursor != nil {
+			cursor := memoryRow{key: page.Cursor.Key, id: page.Cursor.Id}
+			if (!descending && !less(cursor, row)) || (descending && !less(row, cursor)) {
+				continue
+			}
+		}
+
+		if !p.fits() {
+			break
+		}
+
+		read(row.id)
+		p.add(row.key, row.id)
+	}
+
+	return p
+}
+
+//------------------------ IN-MEMORY REPOSITORY (User) -----------------------------//
+func (m *memoryRepository) GetUser(id string) (models.User, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	return user.User, nil
+}
+
+func (m *memoryRepository) GetCredentials(username string) (userCredentials, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, user := range m.users {
+		if strings.ToLower(user.Username) == username {
+			return user, nil
+		}
+	}
+
+	return userCredentials{}, sql.ErrNoRows
+}
+
+func (m *memoryRepository) ListUsers(admin string, filter userFilter, page pageRequest) ([]models.User, int, string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	search := strings.ToLower(filter.Search)
+
+	var rows []memoryRow
+	for _, user := range m.users {
+		if user.Utype != "normal" || !m.inScope(admin, user.Unit) {
+			continue
+		}
+
+		// Deactivated users are left out unless they are asked for
+		if !filter.IncludeInactive && !user.Active {
+			continue
+		}
+
+		if search != "" && !strings.Contains(strings.ToLower(user.Username), search) &&
+			!strings.Contains(strings.ToLower(user.FirstName), search) && !strings.Contains(strings.ToLower(user.LastName), search) {
+			continue
+		}
+
+		row := memoryRow{id: user.Id}
+		switch filter.Sort {
+		case "username":
+			row.key = user.Username
+		case "name":
+			row.key = user.LastName + " " + user.FirstName
+		case "rank":
+			row.key = user.Rank
+		case "unit":
+			row.key = user.Unit
+		}
+		rows = append(rows, row)
+	}
+
+	users := []models.User{}
+	p := memoryPage(rows, page, filter.Descending, func(id string) {
+		users = append(users, m.users[id].User)
+	})
+
+	return users, p.Total, p.Next, nil
+}
+
+func (m *memoryRepository) ListUnitUsers(unit string) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var users []string
+	for _, user := range m.users {
+		if user.Utype == "normal" && user.Active && m.inSubtree(user.Unit, unit) {
+			users = append(users, user.Id)
+		}
+	}
+
+	sort.Strings(users)
+	return users, nil
+}
+
+func (m *memoryRepository) CreateUser(user models.User, passwordHash string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.users[user.Id]; ok || m.usernameTaken(user.Username, user.Id) {
+		return newError(http.StatusConflict, codeConflict, "This username is already taken")
+	}
+
+	m.users[user.Id] = userCredentials{User: user, PasswordHash: passwordHash}
+	return nil
+}
+
+func (m *memoryRepository) UpdateUser(user models.User, passwordHash string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	current, ok := m.users[user.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if m.usernameTaken(user.Username, user.Id) {
+		return newError(http.StatusConflict, codeConflict, "This username is already taken")
+	}
+
+	if passwordHash == "" {
+		passwordHash = current.PasswordHash
+	}
+
+	m.users[user.Id] = userCredentials{User: user, PasswordHash: passwordHash}
+	return nil
+}
+
+func (m *memoryRepository) SetUserActive(id string, active bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if user, ok := m.users[id]; ok {
+		user.Active = active
+		m.users[id] = user
+	}
+
+	return nil
+}
+
+func (m *memoryRepository) UserInScope(admin string, user string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	target, ok := m.users[user]
+	return ok && m.inScope(admin, target.Unit), nil
+}
+
+func (m *memoryRepository) UnitInScope(admin string, unit string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.units[unit]
+	return ok && m.inScope(admin, unit), nil
+}
+
+//------------------------ IN-MEMORY REPOSITORY (Task) -----------------------------//
+// Tasks are stored without their users, which are filled in when they are read like the joins do in SQL
+func (m *memoryRepository) readTask(task models.Task) models.Task {
+	ref := func(id string) *models.UserRef {
+		user, ok := m.users[id]
+		if !ok {
+			return nil
+		}
+		return &models.UserRef{Id: user.Id, Rank: user.Rank, FirstName: user.FirstName, LastName: user.LastName}
+	}
+
+	copyTaskTimes(&task)
+	task.Tags = append([]string{}, task.Tags...)
+	task.Assignee = ref(task.AssignedTo)
+	task.Assigner = ref(task.AssignedBy)
+	task.Verifier = ref(task.VerifiedBy)
+
+	return task
+}
+
+// Appends an event to the history of a task like recordTaskEvent does in SQL
+func (m *memoryRepository) recordEvent(actor string, action string, before *models.Task, after *models.Task) {
+	changes := diffTasks(before, after)
+	if len(changes) == 0 {
+		return
+	}
+
+	current := after
+	if current == nil {
+		current = before
+	}
+
+	m.events = append(m.events, models.TaskEvent{
+		Id:         shortuuid.New(),
+		TaskId:     current.Id,
+		AssignedTo: current.AssignedTo,
+		Actor:      actor,
+		Action:     action,
+		Changes:    changes,
+		CreatedAt:  time.Now().UTC(),
+	})
+}
+
+func (m *memoryRepository) storeTask(task models.Task) {
+	copyTaskTimes(&task)
+	task.Tags = append([]string{}, task.Tags...)
+	sort.Strings(task.Tags)
+	task.Assignee, task.Assigner, task.Verifier = nil, nil, nil
+
+	m.tasks[task.Id] = task
+}
+
+// Stored tasks don't share their timestamps with the callers, a request decoded into a task would change them otherwise
+func copyTaskTimes(task *models.Task) {
+	for _, t := range []**time.Time{&task.DueAt, &task.SubmittedAt, &task.VerifiedAt} {
+		if *t != nil {
+			copied := **t
+			*t = &copied
+		}
+	}
+}
+
+// Every word of the search has to start one of the words of the task name
+func memoryMatch(name string, search string) bool {
+	words := strings.Fields(strings.ToLower(name))
+	for _, term := range strings.Fields(strings.ToLower(search)) {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, term) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *memoryRepository) matchTask(task models.Task, uid string, utype string, due dueFilter, filter taskFilter) bool {
+	if utype == "admin" {
+		assignee, ok := m.users[task.AssignedTo]
+		if !ok || assignee.Utype != "normal" || !m.inScope(uid, assignee.Unit) {
+			return false
+		}
+	} else if task.AssignedTo != uid {
+		return false
+	}
+
+	if due.Overdue || due.DueWithin > 0 {
+		now := time.Now().UTC()
+		open := task.Status == "assigned" || task.Status == "in_progress" || task.Status == "rejected"
+		if !open || task.DueAt == nil {
+			return false
+		}
+
+		if due.Overdue && !task.DueAt.Before(now) {
+			return false
+		}
+
+		if !due.Overdue && (task.DueAt.Before(now) || task.DueAt.After(now.AddDate(0, 0, due.DueWithin))) {
+			return false
+		}
+	}
+
+	if filter.AssignedTo != "" && task.AssignedTo != filter.AssignedTo {
+		return false
+	}
+
+	if len(filter.Priorities) > 0 {
+		found := false
+		for _, p := range filter.Priorities {
+			found = found || p == task.Priority
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if filter.Category != "" && !strings.EqualFold(filter.Category, task.Category) {
+		return false
+	}
+
+	for _, tag := range filter.Tags {
+		found := false
+		for _, t := range task.Tags {
+			found = found || t == tag
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return filter.Search == "" || memoryMatch(task.Name, filter.Search)
+}
+
+// The text sort keys of taskSortColumns, timestamps are written so that they sort in time order
+func memoryTaskKey(task models.Task, column string) string {
+	const layout = "2006-01-02 15:04:05.000000000"
+
+	switch column {
+	case "priority":
+		for i, p := range taskPriorities {
+			if p == task.Priority {
+				return string(rune('0' + i))
+			}
+		}
+		return "3"
+	case "category":
+		return task.Category
+	case "name":
+		return task.Name
+	case "due_at":
+		if task.DueAt == nil {
+			return "9999"
+		}
+		return task.DueAt.UTC().Format(layout)
+	}
+
+	return task.CreatedAt.UTC().Format(layout)
+}
+
+func (m *memoryRepository) GetTask(id string) (models.Task, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return models.Task{}, sql.ErrNoRows
+	}
+
+	return m.readTask(task), nil
+}
+
+func (m *memoryRepository) ListTasks(uid string, utype string, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var rows []memoryRow
+	for _, task := range m.tasks {
+		if m.matchTask(task, uid, utype, due, filter) {
+			rows = append(rows, memoryRow{key: memoryTaskKey(task, filter.Sort), id: task.Id})
+		}
+	}
+
+	tasks := []models.Task{}
+	p := memoryPage(rows, page, filter.Descending, func(id string) {
+		tasks = append(tasks, m.readTask(m.tasks[id]))
+	})
+
+	return tasks, p.Total, p.Next, nil
+}
+
+func (m *memoryRepository) CreateTasks(tasks []models.Task) error {
+	m.Lock()
+	defer m.Unlock()
+
+	// Either all of the tasks are created or none of them
+	for _, task := range tasks {
+		if _, ok := m.tasks[task.Id]; ok {
+			return newError(http.StatusConflict, codeConflict, "This already exists")
+		}
+	}
+
+	for _, task := range tasks {
+		task.VerifiedBy = ""
+		task.Version = 1
+		task.UpdatedAt = task.CreatedAt
+		m.storeTask(task)
+		m.recordEvent(task.AssignedBy, "create", nil, &task)
+	}
+
+	return nil
+}
+
+func (m *memoryRepository) UpdateTask(actor string, before models.Task, after models.Task) error {
+	m.Lock()
+	defer m.Unlock()
+
+	// Like in SQL, the task is only updated while it is still at the version of before
+	if current, ok := m.tasks[after.Id]; !ok || current.Version != before.Version {
+		return preconditionFailed("The task has been changed by someone else, reload it and try again")
+	}
+
+	m.storeTask(after)
+	m.recordEvent(actor, "update", &before, &after)
+	return nil
+}
+
+func (m *memoryRepository) ListComments(task string) ([]models.Comment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var comments []models.Comment
+	for _, comment := range m.comments[task] {
+		author := m.users[comment.Author]
+		comment.AuthorName = formatUserRef(&models.UserRef{Rank: author.Rank, FirstName: author.FirstName, LastName: author.LastName})
+		comments = append(comments, comment)
+	}
+
+	return comments, nil
+}
+
+func (m *memoryRepository) CreateComment(comment models.Comment) error {
+	m.Lock()
+	defer m.Unlock()
+
+	comment.AuthorName = ""
+	m.comments[comment.TaskId] = append(m.comments[comment.TaskId], comment)
+	return nil
+}
+
+func (m *memoryRepository) ListAttachments(task string) ([]models.Attachment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]models.Attachment(nil), m.attachments[task]...), nil
+}
+
+func (m *memoryRepository) GetAttachment(task string, id string) (models.Attachment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, attachment := range m.attachments[task] {
+		if attachment.Id == id {
+			return attachment, nil
+		}
+	}
+
+	return models.Attachment{}, sql.ErrNoRows
+}
+
+func (m *memoryRepository) CreateAttachment(attachment models.Attachment) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.attachments[attachment.TaskId] = append(m.attachments[attachment.TaskId], attachment)
+	return nil
+}
+
+func (m *memoryRepository) ListTaskEvents(task string) ([]models.TaskEvent, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var events []models.TaskEvent
+	for _, event := range m.events {
+		if event.TaskId == task {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+func (m *memoryRepository) ListAuditEvents(admin string, limit int) ([]models.TaskEvent, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var events []models.TaskEvent
+	for i := len(m.events) - 1; i >= 0 && len(events) < limit; i-- {
+		assignee, ok := m.users[m.events[i].AssignedTo]
+		if ok && assignee.Utype == "normal" && m.inScope(admin, assignee.Unit) {
+			events = append(events, m.events[i])
+		}
+	}
+
+	return events, nil
+}
+
+func (m *memoryRepository) DeleteTask(actor string, task models.Task) ([]models.Attachment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	attachments := m.attachments[task.Id]
+	delete(m.comments, task.Id)
+	delete(m.attachments, task.Id)
+	delete(m.tasks, task.Id)
+	m.recordEvent(actor, "delete", &task, nil)
+
+	return attachments, nil
+}
+
+//------------------------ IN-MEMORY REPOSITORY (Unit) -----------------------------//
+func (m *memoryRepository) GetUnit(id string) (models.Unit, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	unit, ok := m.units[id]
+	if !ok {
+		return models.Unit{}, sql.ErrNoRows
+	}
+
+	return unit, nil
+}
+
+func (m *memoryRepository) ListUnits(admin string) ([]models.Unit, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var units []models.Unit
+	for _, unit := range m.units {
+		if m.inScope(admin, unit.Id) {
+			units = append(units, unit)
+		}
+	}
+
+	sort.Slice(units, func(i, j int) bool {
+		return units[i].Id < units[j].Id
+	})
+
+	return units, nil
+}
+
+func (m *memoryRepository) CreateUnit(unit models.Unit) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.units[unit.Id]; ok {
+		return newError(http.StatusConflict, codeConflict, "This already exists")
+	}
+
+	m.units[unit.Id] = unit
+	return nil
+}
+
+func (m *memoryRepository) UpdateUnit(unit models.Unit) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if current, ok := m.units[unit.Id]; ok {
+		current.Name = unit.Name
+		current.Parent = unit.Parent
+		m.units[unit.Id] = current
+	}
+
+	return nil
+}
+
+//------------------------ IN-MEMORY REPOSITORY (Invite) ---------------------------//
+func (m *memoryRepository) ListInvites(admin string) ([]models.Invite, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var invites []models.Invite
+	for _, invite := range m.invites {
+		if m.inScope(admin, invite.Unit) {
+			invites = append(invites, invite)
+		}
+	}
+
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.After(invites[j].CreatedAt)
+	})
+
+	return invites, nil
+}
+
+func (m *memoryRepository) GetInvite(code string) (models.Invite, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	invite, ok := m.invites[code]
+	if !ok {
+		return models.Invite{}, sql.ErrNoRows
+	}
+
+	return invite, nil
+}
+
+func (m *memoryRepository) CreateInvite(invite models.Invite) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.invites[invite.Code] = invite
+	return nil
+}
+
+func (m *memoryRepository) DeleteInvite(code string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if invite, ok := m.invites[code]; ok && invite.UsedBy == "" {
+		delete(m.invites, code)
+	}
+
+	return nil
+}
+
+func (m *memoryRepository) RegisterUser(code string, user models.User, passwordHash string, usedAt time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	invite, ok := m.invites[code]
+	if !ok || invite.UsedBy != "" {
+		return forbidden("Invalid or used invite")
+	}
+
+	if _, ok := m.users[user.Id]; ok || m.usernameTaken(user.Username, user.Id) {
+		return newError(http.StatusConflict, codeConflict, "This username is already taken")
+	}
+
+	m.users[user.Id] = userCredentials{User: user, PasswordHash: passwordHash}
+
+	invite.UsedBy = user.Id
+	invite.UsedAt = &usedAt
+	m.invites[code] = invite
+
+	return nil
+}
+
+//------------------------ IN-MEMORY REPOSITORY (Session) --------------------------//
+func (m *memoryRepository) CreateSession(session session) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.sessions[session.TokenHash] = session
+	return nil
+}
+
+func (m *memoryRepository) GetSession(tokenHash string) (session, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	current, ok := m.sessions[tokenHash]
+	if !ok {
+		return session{}, sql.ErrNoRows
+	}
+
+	return current, nil
+}
+
+func (m *memoryRepository) RotateSession(tokenHash string, next session, revokedAt time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	current, ok := m.sessions[tokenHash]
+	if !ok || current.RevokedAt != nil {
+		return newError(http.StatusUnauthorized, codeInvalidToken, "Refresh token has been revoked")
+	}
+
+	current.RevokedAt = &revokedAt
+	m.sessions[tokenHash] = current
+	m.sessions[next.TokenHash] = next
+
+	return nil
+}
+
+func (m *memoryRepository) RevokeSession(tokenHash string, revokedAt time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if current, ok := m.sessions[tokenHash]; ok && current.RevokedAt == nil {
+		current.RevokedAt = &revokedAt
+		m.sessions[tokenHash] = current
+	}
+
+	return nil
+}
+
+func (m *memoryRepository) RevokeUserSessions(user string, revokedAt time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for hash, current := range m.sessions {
+		if current.User == user && current.RevokedAt == nil {
+			current.RevokedAt = &revokedAt
+			m.sessions[hash] = current
+		}
+	}
+
+	return nil
+}
+
+//------------------------ IN-MEMORY REPOSITORY (Schedule) -------------------------//
+func (m *memoryRepository) GetTemplate(id string) (models.Template, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	template, ok := m.templates[id]
+	if !ok {
+		return models.Template{}, sql.ErrNoRows
+	}
+
+	return template, nil
+}
+
+func (m *memoryRepository) ListTemplates(admin string) ([]models.Template, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var templates []models.Template
+	for _, template := range m.templates {
+		if m.inScope(admin, template.Unit) {
+			templates = append(templates, template)
+		}
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+
+	return templates, nil
+}
+
+func (m *memoryRepository) CreateTemplate(template models.Template) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.templates[template.Id] = template
+	return nil
+}
+
+func (m *memoryRepository) DeleteTemplate(id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, schedule := range m.schedules {
+		if schedule.Template == id {
+			delete(m.schedules, schedule.Id)
+		}
+	}
+
+	delete(m.templates, id)
+	return nil
+}
+
+func (m *memoryRepository) GetSchedule(id string) (models.Schedule, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	schedule, ok := m.schedules[id]
+	if !ok {
+		return models.Schedule{}, sql.ErrNoRows
+	}
+
+	return schedule, nil
+}
+
+func (m *memoryRepository) ListSchedules(admin string) ([]models.Schedule, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var schedules []models.Schedule
+	for _, schedule := range m.schedules {
+		if template, ok := m.templates[schedule.Template]; ok && m.inScope(admin, template.Unit) {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].NextRun.Before(schedules[j].NextRun)
+	})
+
+	return schedules, nil
+}
+
+func (m *memoryRepository) CreateSchedule(schedule models.Schedule) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.schedules[schedule.Id] = schedule
+	return nil
+}
+
+func (m *memoryRepository) StopSchedule(id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if schedule, ok := m.schedules[id]; ok {
+		schedule.Active = false
+		m.schedules[id] = schedule
+	}
+
+	return nil
+}
+
+func (m *memoryRepository) ListDueSchedules(now time.Time) ([]models.Schedule, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var schedules []models.Schedule
+	for _, schedule := range m.schedules {
+		if schedule.Active && !schedule.NextRun.After(now) {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	return schedules, nil
+}
+
+func (m *memoryRepository) RunSchedule(schedule models.Schedule, tasks []models.Task, nextRun time.Time, now time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	run := schedule.Id + "@" + schedule.NextRun.UTC().Format(time.RFC3339Nano)
+	if !m.scheduleRuns[run] {
+		m.scheduleRuns[run] = true
+
+		for _, task := range tasks {
+			task.Version = 1
+			task.UpdatedAt = task.CreatedAt
+			m.storeTask(task)
+			m.recordEvent(task.AssignedBy, "create", nil, &task)
+		}
+	}
+
+	if current, ok := m.schedules[schedule.Id]; ok {
+		current.NextRun = nextRun
+		current.Active = !nextRun.IsZero()
+		m.schedules[schedule.Id] = current
+	}
+
+	return nil
+}
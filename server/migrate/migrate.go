@@ -0,0 +1,464 @@
+// Package migrate keeps the schema of the database up to date. Migrations are the SQL files in
+// migrations/<dialect>/, embedded in the binary and named after the version they bring the schema to,
+// e.g. 0002_add_task_notes.sql. Applied versions are recorded in the schema_migrations table.
+// Every dialect has the same versions, a change to the schema is written once for each of them.
+// Version 1 is the schema of define.sql that the first databases were created from by hand.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var files embed.FS
+
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+)
+
+// A database created by hand from define.sql, before migrations existed. It has to be baselined
+// so that the migrations it already contains are not applied a second time.
+var ErrNotBaselined = errors.New("The database has tables but no schema_migrations, run the server with -migrate baseline to find the migration it matches")
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Reads the embedded migrations of the dialect in the order they are applied
+func Load(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := files.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("No migrations for the %s dialect", dialect)
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("Migration %s has to be named <version>_<name>.sql", entry.Name())
+		}
+
+		content, err := files.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: parts[1], SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("Migration version %d is used twice", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+func ensureTable(db *sql.DB) error {
+	sql := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY NOT NULL,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`
+	_, err := db.Exec(sql)
+	return err
+}
+
+func applied(db *sql.DB) (map[int]time.Time, error) {
+	versions := map[int]time.Time{}
+
+	results, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return versions, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := results.Scan(&version, &appliedAt); err != nil {
+			return versions, err
+		}
+		versions[version] = appliedAt
+	}
+
+	return versions, results.Err()
+}
+
+// Lists every migration along with when it was applied, pending ones have no time
+func GetStatus(db *sql.DB, dialect string) ([]Status, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []Status
+	for _, migration := range migrations {
+		s := Status{Migration: migration}
+		if appliedAt, ok := versions[migration.Version]; ok {
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// Lists the migrations that Up would apply, in order
+func Pending(db *sql.DB, dialect string) ([]Migration, error) {
+	status, err := GetStatus(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBaselined(db, dialect, status); err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			pending = append(pending, s.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Applies every pending migration, each in its own transaction together with its schema_migrations row.
+// A failing migration is rolled back and stops the ones after it.
+func Up(db *sql.DB, dialect string) ([]Migration, error) {
+	pending, err := Pending(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range pending {
+		if err := apply(db, dialect, migration); err != nil {
+			return done, fmt.Errorf("Migration %04d_%s failed: %s", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+func apply(db *sql.DB, dialect string, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if check, ok := checks[migration.Name]; ok {
+		if err := check(tx); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(migration.SQL); err != nil {
+		return err
+	}
+
+	if err := record(tx, dialect, migration); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Migrations that cannot decide on their own how to change the data they find. Their check runs before
+// them and stops the migration with what has to be resolved by hand first.
+var checks = map[string]func(tx *sql.Tx) error{
+	"unique_usernames": checkUniqueUsernames,
+}
+
+// Usernames are compared trimmed and in lower case, which users may not share. Which one of them keeps
+// the username is up to an admin, the others have to be told their new one.
+func checkUniqueUsernames(tx *sql.Tx) error {
+	sql := `SELECT LOWER(TRIM(username)), "user" FROM "user" WHERE LOWER(TRIM(username)) IN
+	(SELECT LOWER(TRIM(username)) FROM "user" GROUP BY LOWER(TRIM(username)) HAVING COUNT(*) > 1)
+	ORDER BY LOWER(TRIM(username)), "user"`
+	results, err := tx.Query(sql)
+	if err != nil {
+		return err
+	}
+
+	defer results.Close()
+
+	var duplicates []string
+	var last string
+	for results.Next() {
+		var username, user string
+		if err := results.Scan(&username, &user); err != nil {
+			return err
+		}
+
+		if len(duplicates) > 0 && username == last {
+			duplicates[len(duplicates)-1] += ", " + user
+		} else {
+			duplicates = append(duplicates, fmt.Sprintf("%q is used by the users %s", username, user))
+		}
+		last = username
+	}
+
+	if err := results.Err(); err != nil {
+		return err
+	}
+
+	if len(duplicates) > 0 {
+		return fmt.Errorf("Usernames have to be unique, rename all but one user of each before migrating: %s", strings.Join(duplicates, "; "))
+	}
+
+	return nil
+}
+
+func record(tx *sql.Tx, dialect string, migration Migration) error {
+	sql := `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`
+	if dialect == Postgres {
+		sql = `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`
+	}
+	_, err := tx.Exec(sql, migration.Version, migration.Name, time.Now().UTC())
+	return err
+}
+
+// Marks the migrations that the schema of a database created by hand already contains as applied, without
+// running them. The schema is compared with the one each migration leaves behind, and the latest migration
+// it matches is returned. Nothing is recorded unless the database matches one of them exactly.
+func Baseline(db *sql.DB, dialect string) (Migration, error) {
+	status, err := GetStatus(db, dialect)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			return Migration{}, fmt.Errorf("The database is already migrated up to %04d_%s", s.Version, s.Name)
+		}
+	}
+
+	actual, err := readSchema(db, dialect)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	migrations, expected, err := replay(db, dialect)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	// The latest match wins, the schema of every migration differs from the one before it
+	match := -1
+	var closest []string
+	for i := range migrations {
+		diff := expected[i].diff(actual)
+		if len(diff) == 0 {
+			match = i
+		}
+		if closest == nil || len(diff) < len(closest) {
+			closest = append([]string{fmt.Sprintf("%04d_%s", migrations[i].Version, migrations[i].Name)}, diff...)
+		}
+	}
+
+	if match < 0 {
+		return Migration{}, fmt.Errorf("The database does not match any migration, the closest is %s which it differs from in: %s",
+			closest[0], strings.Join(closest[1:], ", "))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	defer tx.Rollback()
+
+	for _, migration := range migrations[:match+1] {
+		if err := record(tx, dialect, migration); err != nil {
+			return Migration{}, err
+		}
+	}
+
+	return migrations[match], tx.Commit()
+}
+
+// The tables with their columns and the indexes and triggers of a database, as "table.column",
+// "index name" and "trigger name"
+type schema map[string]bool
+
+// Lists what is missing from the actual schema and what it has on top of s
+func (s schema) diff(actual schema) []string {
+	var diff []string
+	for name := range s {
+		if !actual[name] {
+			diff = append(diff, "missing "+name)
+		}
+	}
+	for name := range actual {
+		if !s[name] {
+			diff = append(diff, "unexpected "+name)
+		}
+	}
+
+	sort.Strings(diff)
+	return diff
+}
+
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func readSchema(q querier, dialect string) (schema, error) {
+	sql := `SELECT 'table ' || m.name || '.' || p.name FROM sqlite_master m, pragma_table_info(m.name) p
+	WHERE m.type = 'table' AND m.name NOT IN ('schema_migrations', 'sqlite_sequence')
+	UNION ALL SELECT type || ' ' || name FROM sqlite_master WHERE type IN ('index', 'trigger')`
+	if dialect == Postgres {
+		sql = `SELECT 'table ' || table_name || '.' || column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'
+		UNION ALL SELECT 'index ' || indexname FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'`
+	}
+
+	results, err := q.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	s := schema{}
+	for results.Next() {
+		var name string
+		if err := results.Scan(&name); err != nil {
+			return nil, err
+		}
+		s[name] = true
+	}
+
+	return s, results.Err()
+}
+
+// Applies the migrations one by one to an empty database and reads the schema after each of them.
+// SQLite uses a database in memory, PostgreSQL a schema of its own within a transaction that is rolled back.
+func replay(db *sql.DB, dialect string) ([]Migration, []schema, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var q querier
+	if dialect == Postgres {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`CREATE SCHEMA migrate_baseline`); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tx.Exec(`SET LOCAL search_path TO migrate_baseline`); err != nil {
+			return nil, nil, err
+		}
+		q = tx
+	} else {
+		empty := sql.OpenDB(dsnConnector{dsn: ":memory:", driver: db.Driver()})
+		defer empty.Close()
+
+		// Every connection has a database in memory of its own
+		empty.SetMaxOpenConns(1)
+		q = empty
+	}
+
+	var schemas []schema
+	for _, migration := range migrations {
+		if _, err := q.Exec(migration.SQL); err != nil {
+			return nil, nil, fmt.Errorf("Migration %04d_%s failed: %s", migration.Version, migration.Name, err)
+		}
+
+		s, err := readSchema(q, dialect)
+		if err != nil {
+			return nil, nil, err
+		}
+		schemas = append(schemas, s)
+	}
+
+	return migrations, schemas, nil
+}
+
+// Opens databases of the same driver with another data source name
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Nothing being applied while other tables exist means the schema was created by hand
+func checkBaselined(db *sql.DB, dialect string, status []Status) error {
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			return nil
+		}
+	}
+
+	var count int
+	sql := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')`
+	if dialect == Postgres {
+		sql = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`
+	}
+
+	if err := db.QueryRow(sql).Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return ErrNotBaselined
+	}
+
+	return nil
+}
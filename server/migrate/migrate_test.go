@@ -0,0 +1,247 @@
+package migrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// The task search migration needs FTS5, which the driver only includes with the sqlite_fts5 tag
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		t.Fatal(err)
+	}
+	if !fts5 {
+		t.Skip("SQLite was built without FTS5, run go test -tags sqlite_fts5 ./... to include it")
+	}
+
+	return db
+}
+
+// Creates the schema of the migrations up to the version by hand, the way define.sql was run
+func createByHand(t *testing.T, db *sql.DB, version int) {
+	migrations, err := Load(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, migration := range migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, err := db.Exec(migration.SQL); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	sqlite, err := Load(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postgres, err := Load(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("sqlite has %d migrations, postgres %d", len(sqlite), len(postgres))
+	}
+
+	for i := range sqlite {
+		if sqlite[i].Version != i+1 || sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("migration %d is %04d_%s in sqlite and %04d_%s in postgres", i+1, sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+	}
+}
+
+// A database created from the original define.sql keeps its users and tasks on the way up
+func TestUpFromDefineSQL(t *testing.T) {
+	db := openSQLite(t)
+	createByHand(t, db, 1)
+
+	for _, sql := range []string{
+		`INSERT INTO user (user, username, password_hash, type, amb, depot, platoon, section, man, rank, first_name, last_name) VALUES
+			('adm', 'Adm', 'hash', 'admin', 1, -1, -1, -1, -1, 'CPT', 'Amb', 'Admin'),
+			('dep', 'dep', 'hash', 'admin', 1, 2, -1, -1, -1, 'LTA', 'Depot', 'Admin'),
+			('n1', 'n1', 'hash', 'normal', 1, 2, 3, 4, 1, 'CPL', 'Ann', 'Alpha'),
+			('n2', 'n2', 'hash', 'normal', 1, 2, 3, -1, 2, 'PTE', 'Ben', 'Bravo'),
+			('n3', 'n3', 'hash', 'normal', 2, 1, -1, -1, 3, 'PTE', 'Cal', 'Charlie'),
+			('n4', 'N1', 'hash', 'normal', 2, 1, -1, -1, 4, 'PTE', 'Dan', 'Delta')`,
+		`INSERT INTO task (task, name, assigned_to, assigned_by, completed, verified, verified_by) VALUES
+			('t1', 'Open', 'n1', 'dep', FALSE, FALSE, ''),
+			('t2', 'Done', 'n1', 'dep', TRUE, FALSE, ''),
+			('t3', 'Checked', 'n2', 'adm', TRUE, TRUE, 'adm')`,
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Up(db, SQLite); err != ErrNotBaselined {
+		t.Fatalf("Up before the baseline = %v, want ErrNotBaselined", err)
+	}
+
+	migration, err := Baseline(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration.Version != 1 {
+		t.Fatalf("Baseline matched %04d_%s, want 0001_initial", migration.Version, migration.Name)
+	}
+
+	// Usernames that only differ in case stop the migration until an admin renames all but one of them
+	applied, err := Up(db, SQLite)
+	if err == nil || !strings.Contains(err.Error(), `"n1" is used by the users n1, n4`) {
+		t.Fatalf("Up with duplicate usernames = %v, want them listed", err)
+	}
+	if len(applied) == 0 || applied[len(applied)-1].Name != "task_search" {
+		t.Errorf("Up applied %v, want everything up to 0013_task_search", applied)
+	}
+
+	if _, err := db.Exec(`UPDATE user SET username = ' Dan ' WHERE user = 'n4'`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Up(db, SQLite); err != nil {
+		t.Fatal(err)
+	}
+
+	units := map[string]string{}
+	results, err := db.Query(`SELECT unit, level || ' ' || name || ' under ' || COALESCE(parent, '-') FROM unit`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer results.Close()
+	for results.Next() {
+		var id, unit string
+		if err := results.Scan(&id, &unit); err != nil {
+			t.Fatal(err)
+		}
+		units[id] = unit
+	}
+
+	want := map[string]string{
+		"amb1":                          "amb AMB 1 under -",
+		"amb2":                          "amb AMB 2 under -",
+		"amb1-depot2":                   "depot Depot 2 under amb1",
+		"amb2-depot1":                   "depot Depot 1 under amb2",
+		"amb1-depot2-platoon3":          "platoon Platoon 3 under amb1-depot2",
+		"amb1-depot2-platoon3-section4": "section Section 4 under amb1-depot2-platoon3",
+	}
+	if len(units) != len(want) {
+		t.Errorf("units = %v, want %v", units, want)
+	}
+	for id, unit := range want {
+		if units[id] != unit {
+			t.Errorf("unit %s = %q, want %q", id, units[id], unit)
+		}
+	}
+
+	users := []struct{ user, username, unit string }{
+		{"adm", "adm", "amb1"},
+		{"dep", "dep", "amb1-depot2"},
+		{"n1", "n1", "amb1-depot2-platoon3-section4"},
+		{"n2", "n2", "amb1-depot2-platoon3"},
+		{"n3", "n3", "amb2-depot1"},
+		// Usernames are stored the way logins look them up
+		{"n4", "dan", "amb2-depot1"},
+	}
+	for _, want := range users {
+		var unit, username string
+		if err := db.QueryRow(`SELECT unit, username FROM user WHERE user = ?`, want.user).Scan(&unit, &username); err != nil {
+			t.Fatal(err)
+		}
+		if unit != want.unit || username != want.username {
+			t.Errorf("user %s is %s in %s, want %s in %s", want.user, username, unit, want.username, want.unit)
+		}
+	}
+
+	for task, status := range map[string]string{"t1": "assigned", "t2": "submitted", "t3": "verified"} {
+		var got string
+		var version int
+		if err := db.QueryRow(`SELECT status, version FROM task WHERE task = ?`, task).Scan(&got, &version); err != nil {
+			t.Fatal(err)
+		}
+		if got != status || version != 1 {
+			t.Errorf("task %s is %s at version %d, want %s at version 1", task, got, version, status)
+		}
+	}
+
+	// The search index holds the tasks that were there before it
+	var found string
+	if err := db.QueryRow(`SELECT task FROM task_search WHERE task_search MATCH 'checked'`).Scan(&found); err != nil || found != "t3" {
+		t.Errorf("search = %q, %v", found, err)
+	}
+}
+
+// Databases created from a later define.sql match a later migration
+func TestBaselineFindsTheVersion(t *testing.T) {
+	migrations, err := Load(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []int{1, 4, 13, 14, len(migrations)} {
+		db := openSQLite(t)
+		createByHand(t, db, version)
+
+		migration, err := Baseline(db, SQLite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if migration.Version != version {
+			t.Errorf("Baseline matched %04d_%s, want version %d", migration.Version, migration.Name, version)
+		}
+
+		pending, err := Pending(db, SQLite)
+		if err != nil || len(pending) != len(migrations)-version {
+			t.Errorf("%d pending after the baseline at %d, %v", len(pending), version, err)
+		}
+
+		if _, err := Up(db, SQLite); err != nil {
+			t.Errorf("Up after the baseline at %d: %v", version, err)
+		}
+
+		if _, err := Baseline(db, SQLite); err == nil {
+			t.Errorf("Baseline of a migrated database succeeded")
+		}
+	}
+}
+
+// A schema that no migration leaves behind is not baselined at all
+func TestBaselineRejectsOtherSchemas(t *testing.T) {
+	db := openSQLite(t)
+	createByHand(t, db, 1)
+
+	if _, err := db.Exec(`ALTER TABLE task ADD COLUMN created_at DATETIME`); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Baseline(db, SQLite)
+	if err == nil || !strings.Contains(err.Error(), "unexpected table task.created_at") {
+		t.Fatalf("Baseline = %v, want a difference in task.created_at", err)
+	}
+
+	status, err := GetStatus(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			t.Errorf("%04d_%s was recorded", s.Version, s.Name)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+-- Tasks keep when they were created, when they are due and when they were completed and verified
+-- Existing tasks are taken to be created when the migration runs, the other times are not known
+
+ALTER TABLE "task" ADD COLUMN created_at TIMESTAMPTZ;
+ALTER TABLE "task" ADD COLUMN due_at TIMESTAMPTZ;
+ALTER TABLE "task" ADD COLUMN completed_at TIMESTAMPTZ;
+ALTER TABLE "task" ADD COLUMN verified_at TIMESTAMPTZ;
+
+UPDATE "task" SET created_at = NOW();
+
+ALTER TABLE "task" ALTER COLUMN created_at SET NOT NULL;
@@ -0,0 +1,16 @@
+-- Append-only history of every task mutation, rows are never updated or deleted
+-- There is no foreign key on task so that the history outlives deleted tasks
+
+CREATE TABLE "task_event" (
+  "task_event" TEXT PRIMARY KEY NOT NULL,
+  task TEXT NOT NULL,
+  assigned_to TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  action TEXT CHECK( action IN ('create', 'update', 'delete') ) NOT NULL,
+  changes TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  FOREIGN KEY(assigned_to) REFERENCES "user"("user"),
+  FOREIGN KEY(actor) REFERENCES "user"("user")
+);
+
+CREATE INDEX task_event_task ON "task_event"(task);
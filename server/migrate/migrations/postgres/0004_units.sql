@@ -0,0 +1,41 @@
+-- Users belong to a unit of a tree instead of the amb, depot, platoon and section numbers, see
+-- sqlite/0004_units.sql for how the numbers in use become units
+
+CREATE TABLE "unit" (
+  "unit" TEXT PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+  level TEXT CHECK( level IN ('amb', 'depot', 'platoon', 'section') ) NOT NULL,
+  parent TEXT,
+  FOREIGN KEY(parent) REFERENCES "unit"("unit")
+);
+
+CREATE INDEX unit_parent ON "unit"(parent);
+
+INSERT INTO "unit" ("unit", name, level, parent)
+SELECT DISTINCT 'amb' || amb, 'AMB ' || amb, 'amb', NULL FROM "user";
+
+INSERT INTO "unit" ("unit", name, level, parent)
+SELECT DISTINCT 'amb' || amb || '-depot' || depot, 'Depot ' || depot, 'depot', 'amb' || amb
+FROM "user" WHERE depot <> -1;
+
+INSERT INTO "unit" ("unit", name, level, parent)
+SELECT DISTINCT 'amb' || amb || '-depot' || depot || '-platoon' || platoon, 'Platoon ' || platoon, 'platoon',
+  'amb' || amb || '-depot' || depot
+FROM "user" WHERE depot <> -1 AND platoon <> -1;
+
+INSERT INTO "unit" ("unit", name, level, parent)
+SELECT DISTINCT 'amb' || amb || '-depot' || depot || '-platoon' || platoon || '-section' || section, 'Section ' || section, 'section',
+  'amb' || amb || '-depot' || depot || '-platoon' || platoon
+FROM "user" WHERE depot <> -1 AND platoon <> -1 AND section <> -1;
+
+ALTER TABLE "user" ADD COLUMN unit TEXT REFERENCES "unit"("unit");
+
+UPDATE "user" SET unit = CASE
+  WHEN depot = -1 THEN 'amb' || amb
+  WHEN platoon = -1 THEN 'amb' || amb || '-depot' || depot
+  WHEN section = -1 THEN 'amb' || amb || '-depot' || depot || '-platoon' || platoon
+  ELSE 'amb' || amb || '-depot' || depot || '-platoon' || platoon || '-section' || section
+END;
+
+ALTER TABLE "user" ALTER COLUMN unit SET NOT NULL;
+ALTER TABLE "user" DROP COLUMN amb, DROP COLUMN depot, DROP COLUMN platoon, DROP COLUMN section;
@@ -0,0 +1,3 @@
+-- Deactivated users can no longer log in, they are kept for the tasks and history that refer to them
+
+ALTER TABLE "user" ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
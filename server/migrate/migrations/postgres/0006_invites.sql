@@ -0,0 +1,15 @@
+-- Registration is only possible with a single-use invite created by an admin, which fixes the type and unit
+
+CREATE TABLE "invite" (
+  "invite" TEXT PRIMARY KEY NOT NULL,
+  type TEXT CHECK( type IN ('normal', 'admin') ) NOT NULL,
+  unit TEXT NOT NULL,
+  created_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_by TEXT,
+  used_at TIMESTAMPTZ,
+  FOREIGN KEY(unit) REFERENCES "unit"("unit"),
+  FOREIGN KEY(created_by) REFERENCES "user"("user"),
+  FOREIGN KEY(used_by) REFERENCES "user"("user")
+);
@@ -0,0 +1,13 @@
+-- Discussion thread of a task between the assignee and the admins above them
+
+CREATE TABLE "task_comment" (
+  "task_comment" TEXT PRIMARY KEY NOT NULL,
+  task TEXT NOT NULL,
+  author TEXT NOT NULL,
+  body TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  FOREIGN KEY(task) REFERENCES "task"("task"),
+  FOREIGN KEY(author) REFERENCES "user"("user")
+);
+
+CREATE INDEX task_comment_task ON "task_comment"(task);
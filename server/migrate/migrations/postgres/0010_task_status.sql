@@ -0,0 +1,13 @@
+-- The completed and verified flags become the status of the task workflow, see sqlite/0010_task_status.sql
+
+ALTER TABLE "task" ADD COLUMN status TEXT CHECK( status IN ('assigned', 'in_progress', 'submitted', 'verified', 'rejected') ) NOT NULL DEFAULT 'assigned';
+ALTER TABLE "task" ADD COLUMN rejection_reason TEXT NOT NULL DEFAULT '';
+
+UPDATE "task" SET status = CASE
+  WHEN verified THEN 'verified'
+  WHEN completed THEN 'submitted'
+  ELSE 'assigned'
+END;
+
+ALTER TABLE "task" RENAME COLUMN completed_at TO submitted_at;
+ALTER TABLE "task" DROP COLUMN completed, DROP COLUMN verified;
@@ -0,0 +1,44 @@
+-- Reusable task definitions, owned by the unit of the admin that created them
+
+CREATE TABLE "task_template" (
+  "task_template" TEXT PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+  due_in_days INT NOT NULL DEFAULT 0,
+  unit TEXT NOT NULL,
+  created_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  FOREIGN KEY(unit) REFERENCES "unit"("unit"),
+  FOREIGN KEY(created_by) REFERENCES "user"("user")
+);
+
+-- Recurring assignment of a template to either a single user or every normal user within a unit
+-- The rule is a cron expression (or daily, weekly, monthly), next_run is the next time it is due
+
+CREATE TABLE "task_schedule" (
+  "task_schedule" TEXT PRIMARY KEY NOT NULL,
+  template TEXT NOT NULL,
+  rule TEXT NOT NULL,
+  assigned_to TEXT,
+  unit TEXT,
+  created_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  next_run TIMESTAMPTZ NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  CHECK( (assigned_to IS NULL) != (unit IS NULL) ),
+  FOREIGN KEY(template) REFERENCES "task_template"("task_template"),
+  FOREIGN KEY(assigned_to) REFERENCES "user"("user"),
+  FOREIGN KEY(unit) REFERENCES "unit"("unit"),
+  FOREIGN KEY(created_by) REFERENCES "user"("user")
+);
+
+CREATE INDEX task_schedule_next_run ON "task_schedule"(next_run);
+
+-- Every run that has been materialised, so that the same run never creates its tasks twice
+
+CREATE TABLE "task_schedule_run" (
+  schedule TEXT NOT NULL,
+  run_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY(schedule, run_at),
+  FOREIGN KEY(schedule) REFERENCES "task_schedule"("task_schedule")
+);
@@ -0,0 +1,8 @@
+-- Task names and comment bodies are searched through generated tsvector columns instead of FTS5 tables,
+-- which needs PostgreSQL 12 or later
+
+ALTER TABLE "task" ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', name)) STORED;
+ALTER TABLE "task_comment" ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', body)) STORED;
+
+CREATE INDEX task_search ON "task" USING GIN(search);
+CREATE INDEX task_comment_search ON "task_comment" USING GIN(search);
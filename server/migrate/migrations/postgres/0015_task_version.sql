@@ -0,0 +1,9 @@
+-- Every update of a task bumps its version, which clients send back to only update the task they have read
+-- Existing tasks start at version 1 as if they were last updated when they were created
+
+ALTER TABLE "task" ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "task" ADD COLUMN updated_at TIMESTAMPTZ;
+
+UPDATE "task" SET updated_at = created_at;
+
+ALTER TABLE "task" ALTER COLUMN updated_at SET NOT NULL;
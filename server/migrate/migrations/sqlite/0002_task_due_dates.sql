@@ -0,0 +1,28 @@
+-- Tasks keep when they were created, when they are due and when they were completed and verified
+-- SQLite cannot add a column without a default to a table that has rows, so the table is rebuilt.
+-- Existing tasks are taken to be created when the migration runs, the other times are not known.
+
+CREATE TABLE 'task_due_dates' (
+  'task' TEXT PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+  assigned_to TEXT NOT NULL,
+  assigned_by TEXT NOT NULL,
+  completed BOOLEAN NOT NULL DEFAULT FALSE,
+  verified BOOLEAN NOT NULL DEFAULT FALSE,
+  verified_by TEXT NOT NULL,
+
+  created_at DATETIME NOT NULL,
+  due_at DATETIME,
+  completed_at DATETIME,
+  verified_at DATETIME,
+
+  FOREIGN KEY(assigned_to) REFERENCES 'user'('user'),
+  FOREIGN KEY(assigned_by) REFERENCES 'user'('user'),
+  FOREIGN KEY(verified_by) REFERENCES 'user'('user')
+);
+
+INSERT INTO task_due_dates (task, name, assigned_to, assigned_by, completed, verified, verified_by, created_at)
+SELECT task, name, assigned_to, assigned_by, completed, verified, verified_by, CURRENT_TIMESTAMP FROM task;
+
+DROP TABLE task;
+ALTER TABLE task_due_dates RENAME TO task;
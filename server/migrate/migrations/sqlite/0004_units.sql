@@ -0,0 +1,62 @@
+-- Users belong to a unit of a tree instead of the amb, depot, platoon and section numbers, where -1 stood for
+-- every unit of that level. Every combination of numbers in use becomes a unit named after its number, e.g.
+-- amb1-depot2 is "Depot 2" under "AMB 1", and every user is moved to the deepest unit of their numbers. An admin
+-- of a depot keeps the users of its platoons and sections, which are now the units below theirs.
+
+CREATE TABLE 'unit' (
+  'unit' TEXT PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+  level TEXT CHECK( level IN ('amb', 'depot', 'platoon', 'section') ) NOT NULL,
+  parent TEXT,
+  FOREIGN KEY(parent) REFERENCES 'unit'('unit')
+);
+
+CREATE INDEX unit_parent ON unit(parent);
+
+INSERT INTO unit (unit, name, level, parent)
+SELECT DISTINCT 'amb' || amb, 'AMB ' || amb, 'amb', NULL FROM user;
+
+INSERT INTO unit (unit, name, level, parent)
+SELECT DISTINCT 'amb' || amb || '-depot' || depot, 'Depot ' || depot, 'depot', 'amb' || amb
+FROM user WHERE depot <> -1;
+
+INSERT INTO unit (unit, name, level, parent)
+SELECT DISTINCT 'amb' || amb || '-depot' || depot || '-platoon' || platoon, 'Platoon ' || platoon, 'platoon',
+  'amb' || amb || '-depot' || depot
+FROM user WHERE depot <> -1 AND platoon <> -1;
+
+INSERT INTO unit (unit, name, level, parent)
+SELECT DISTINCT 'amb' || amb || '-depot' || depot || '-platoon' || platoon || '-section' || section, 'Section ' || section, 'section',
+  'amb' || amb || '-depot' || depot || '-platoon' || platoon
+FROM user WHERE depot <> -1 AND platoon <> -1 AND section <> -1;
+
+-- SQLite cannot drop the numbers while they are in use, so the table is rebuilt
+
+CREATE TABLE 'user_unit' (
+  'user' TEXT PRIMARY KEY NOT NULL,
+  username TEXT NOT NULL,
+  password_hash TEXT NOT NULL,
+  type TEXT CHECK( type IN ('normal', 'admin') ) NOT NULL,
+
+  unit TEXT NOT NULL,
+  man INT NOT NULL DEFAULT -1,
+
+  rank TEXT NOT NULL,
+  first_name TEXT NOT NULL,
+  last_name TEXT NOT NULL,
+  FOREIGN KEY(unit) REFERENCES 'unit'('unit')
+);
+
+INSERT INTO user_unit (user, username, password_hash, type, unit, man, rank, first_name, last_name)
+SELECT user, username, password_hash, type,
+  CASE
+    WHEN depot = -1 THEN 'amb' || amb
+    WHEN platoon = -1 THEN 'amb' || amb || '-depot' || depot
+    WHEN section = -1 THEN 'amb' || amb || '-depot' || depot || '-platoon' || platoon
+    ELSE 'amb' || amb || '-depot' || depot || '-platoon' || platoon || '-section' || section
+  END,
+  man, rank, first_name, last_name
+FROM user;
+
+DROP TABLE user;
+ALTER TABLE user_unit RENAME TO user;
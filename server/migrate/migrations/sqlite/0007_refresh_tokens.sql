@@ -0,0 +1,12 @@
+-- Refresh tokens are rotated on every use, only their SHA-256 hash is stored
+
+CREATE TABLE 'refresh_token' (
+  'refresh_token' TEXT PRIMARY KEY NOT NULL,
+  user TEXT NOT NULL,
+  created_at DATETIME NOT NULL,
+  expires_at DATETIME NOT NULL,
+  revoked_at DATETIME,
+  FOREIGN KEY(user) REFERENCES 'user'('user')
+);
+
+CREATE INDEX refresh_token_user ON refresh_token(user);
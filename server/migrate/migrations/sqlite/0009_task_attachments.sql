@@ -0,0 +1,15 @@
+-- Evidence files attached to a task, the contents are kept in the blob store under the attachment id
+
+CREATE TABLE 'task_attachment' (
+  'task_attachment' TEXT PRIMARY KEY NOT NULL,
+  task TEXT NOT NULL,
+  uploaded_by TEXT NOT NULL,
+  filename TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  size INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  FOREIGN KEY(task) REFERENCES 'task'('task'),
+  FOREIGN KEY(uploaded_by) REFERENCES 'user'('user')
+);
+
+CREATE INDEX task_attachment_task ON task_attachment(task);
@@ -0,0 +1,36 @@
+-- The completed and verified flags become the status of the task workflow. Verified tasks stay verified,
+-- completed ones are submitted for verification and the rest are assigned. The time a task was completed
+-- is kept as the time it was submitted. SQLite cannot drop the flags, so the table is rebuilt.
+
+CREATE TABLE 'task_status' (
+  'task' TEXT PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+  assigned_to TEXT NOT NULL,
+  assigned_by TEXT NOT NULL,
+  verified_by TEXT NOT NULL,
+
+  status TEXT CHECK( status IN ('assigned', 'in_progress', 'submitted', 'verified', 'rejected') ) NOT NULL DEFAULT 'assigned',
+  rejection_reason TEXT NOT NULL DEFAULT '',
+
+  created_at DATETIME NOT NULL,
+  due_at DATETIME,
+  submitted_at DATETIME,
+  verified_at DATETIME,
+
+  FOREIGN KEY(assigned_to) REFERENCES 'user'('user'),
+  FOREIGN KEY(assigned_by) REFERENCES 'user'('user'),
+  FOREIGN KEY(verified_by) REFERENCES 'user'('user')
+);
+
+INSERT INTO task_status (task, name, assigned_to, assigned_by, verified_by, status, created_at, due_at, submitted_at, verified_at)
+SELECT task, name, assigned_to, assigned_by, verified_by,
+  CASE
+    WHEN verified THEN 'verified'
+    WHEN completed THEN 'submitted'
+    ELSE 'assigned'
+  END,
+  created_at, due_at, completed_at, verified_at
+FROM task;
+
+DROP TABLE task;
+ALTER TABLE task_status RENAME TO task;
@@ -0,0 +1,18 @@
+-- Tasks have a priority and a category, existing tasks are normal and have no category
+
+ALTER TABLE 'task' ADD COLUMN priority TEXT CHECK( priority IN ('low', 'normal', 'high', 'critical') ) NOT NULL DEFAULT 'normal';
+ALTER TABLE 'task' ADD COLUMN category TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX task_priority ON task(priority);
+CREATE INDEX task_category ON task(category);
+
+-- Free-form labels of a task, stored lower case
+
+CREATE TABLE 'task_tag' (
+  task TEXT NOT NULL,
+  tag TEXT NOT NULL,
+  PRIMARY KEY(task, tag),
+  FOREIGN KEY(task) REFERENCES 'task'('task')
+);
+
+CREATE INDEX task_tag_tag ON task_tag(tag);
@@ -0,0 +1,31 @@
+-- Full text index of the task names, kept up to date by triggers
+
+CREATE VIRTUAL TABLE task_search USING fts5(task UNINDEXED, name);
+
+CREATE TRIGGER task_search_insert AFTER INSERT ON task BEGIN
+  INSERT INTO task_search (task, name) VALUES (new.task, new.name);
+END;
+
+CREATE TRIGGER task_search_update AFTER UPDATE OF name ON task BEGIN
+  UPDATE task_search SET name = new.name WHERE task = old.task;
+END;
+
+CREATE TRIGGER task_search_delete AFTER DELETE ON task BEGIN
+  DELETE FROM task_search WHERE task = old.task;
+END;
+
+INSERT INTO task_search (task, name) SELECT task, name FROM task;
+
+-- Full text index of the comment bodies, kept up to date by triggers
+
+CREATE VIRTUAL TABLE task_comment_search USING fts5(task UNINDEXED, task_comment UNINDEXED, body);
+
+CREATE TRIGGER task_comment_search_insert AFTER INSERT ON task_comment BEGIN
+  INSERT INTO task_comment_search (task, task_comment, body) VALUES (new.task, new.task_comment, new.body);
+END;
+
+CREATE TRIGGER task_comment_search_delete AFTER DELETE ON task_comment BEGIN
+  DELETE FROM task_comment_search WHERE task_comment = old.task_comment;
+END;
+
+INSERT INTO task_comment_search (task, task_comment, body) SELECT task, task_comment, body FROM task_comment;
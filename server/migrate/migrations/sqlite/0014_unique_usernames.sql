@@ -0,0 +1,6 @@
+-- Usernames are stored trimmed and in lower case, the way logins look them up, and compared case insensitively.
+-- Users sharing one have to be renamed first, the migration stops with a list of them until they are.
+
+UPDATE user SET username = LOWER(TRIM(username));
+
+CREATE UNIQUE INDEX user_username ON user(username COLLATE NOCASE);
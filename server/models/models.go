@@ -1,17 +1,35 @@
 package models
 
+import "time"
+
 type User struct {
 	Id        string `json:"id"`
 	Username  string `json:"username"`
 	Utype     string `json:"utype"`
-	Amb       int    `json:"amb"`
-	Depot     int    `json:"depot"`
-	Platoon   int    `json:"platoon"`
-	Section   int    `json:"section"`
+	Unit      string `json:"unit"`
 	Man       int    `json:"man"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Rank      string `json:"rank"`
+	Active    bool   `json:"active"`
+}
+
+type Unit struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Level  string `json:"level"`
+	Parent string `json:"parent"`
+}
+
+type Invite struct {
+	Code      string     `json:"code"`
+	Type      string     `json:"type"`
+	Unit      string     `json:"unit"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedBy    string     `json:"used_by"`
+	UsedAt    *time.Time `json:"used_at"`
 }
 
 type Task struct {
@@ -19,7 +37,91 @@ type Task struct {
 	Name       string `json:"name"`
 	AssignedTo string `json:"assigned_to"`
 	AssignedBy string `json:"assigned_by"`
-	Completed  bool   `json:"completed"`
-	Verified   bool   `json:"verified"`
 	VerifiedBy string `json:"verified_by"`
+
+	// One of assigned, in_progress, submitted, verified or rejected
+	Status          string `json:"status"`
+	RejectionReason string `json:"rejection_reason"`
+
+	// One of low, normal, high or critical
+	Priority string   `json:"priority"`
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	DueAt       *time.Time `json:"due_at"`
+	SubmittedAt *time.Time `json:"submitted_at"`
+	VerifiedAt  *time.Time `json:"verified_at"`
+
+	// Bumped on every update. Updates carrying a version are refused once the task has moved past it
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// The users behind AssignedTo, AssignedBy and VerifiedBy, Verifier is nil until the task is verified
+	Assignee *UserRef `json:"assignee"`
+	Assigner *UserRef `json:"assigner"`
+	Verifier *UserRef `json:"verifier"`
+}
+
+// Short reference to a user, enough to show them and link back to their record
+type UserRef struct {
+	Id        string `json:"id"`
+	Rank      string `json:"rank"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type Comment struct {
+	Id         string    `json:"id"`
+	TaskId     string    `json:"task_id"`
+	Author     string    `json:"author"`
+	AuthorName string    `json:"author_name"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Attachment struct {
+	Id          string    `json:"id"`
+	TaskId      string    `json:"task_id"`
+	UploadedBy  string    `json:"uploaded_by"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Template struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	DueInDays int       `json:"due_in_days"`
+	Unit      string    `json:"unit"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Schedule struct {
+	Id         string    `json:"id"`
+	Template   string    `json:"template"`
+	Rule       string    `json:"rule"`
+	AssignedTo string    `json:"assigned_to"`
+	Unit       string    `json:"unit"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	NextRun    time.Time `json:"next_run"`
+	Active     bool      `json:"active"`
+}
+
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type TaskEvent struct {
+	Id         string                 `json:"id"`
+	TaskId     string                 `json:"task_id"`
+	AssignedTo string                 `json:"assigned_to"`
+	Actor      string                 `json:"actor"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes"`
+	CreatedAt  time.Time              `json:"created_at"`
 }
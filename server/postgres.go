@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//------------------------ POSTGRESQL ----------------------------------------------//
+// Task names and comment bodies are searched through their generated tsvector columns
+var postgresDialect = dialect{
+	Name: "postgres",
+	GroupConcat: func(column string) string {
+		return "STRING_AGG(" + column + ", ',')"
+	},
+	AddTaskSearch: func(sql *string, args *[]interface{}, search string) {
+		query := tsQuery(search)
+		*sql += ` AND (task.search @@ TO_TSQUERY('simple', ?)
+		OR task.task IN (SELECT task FROM task_comment WHERE task_comment.search @@ TO_TSQUERY('simple', ?)))`
+		*args = append(*args, query, query)
+	},
+}
+
+// Turns free text into a tsquery matching every word as a prefix, quoting keeps the tsquery syntax out of it
+func tsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		word = strings.Replace(strings.Replace(word, `\`, `\\`, -1), `'`, `''`, -1)
+		terms = append(terms, `'`+word+`':*`)
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// Opens a PostgreSQL database, every connection works in UTC like the SQLite database does
+func openPostgres(dsn string) (*sql.DB, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	if query.Get("timezone") == "" {
+		query.Set("timezone", "UTC")
+	}
+	u.RawQuery = query.Encode()
+
+	connector, err := pq.NewConnector(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.OpenDB(rebindConnector{connector}), nil
+}
+
+// Queries are written with ? placeholders, which PostgreSQL only knows as $1, $2 and so on. The connections
+// rewrite them before they reach the server so that the same queries run on both databases.
+type rebindConnector struct {
+	driver.Connector
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return rebindConn{conn}, nil
+}
+
+// Wraps a connection of lib/pq, which implements every optional interface used here
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// Queries without arguments are left alone, lib/pq runs them as they are and they can hold several statements
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) > 0 {
+		query = rebind(query)
+	}
+
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if len(args) > 0 {
+		query = rebind(query)
+	}
+
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c rebindConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+// Numbers the ? placeholders of a query, question marks within quotes are kept
+func rebind(query string) string {
+	var b strings.Builder
+	var quote rune
+	n := 0
+
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
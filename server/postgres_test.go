@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  string
+	}{
+		{`SELECT 1`, `SELECT 1`},
+		{`SELECT * FROM task WHERE task = ?`, `SELECT * FROM task WHERE task = $1`},
+		{`UPDATE task SET name = ?, version = ? WHERE task = ? AND version = ?`, `UPDATE task SET name = $1, version = $2 WHERE task = $3 AND version = $4`},
+		// Question marks within quotes are part of the value or the name
+		{`SELECT '?' FROM "user" WHERE name = ?`, `SELECT '?' FROM "user" WHERE name = $1`},
+		{`SELECT "what?" FROM t WHERE a = ? AND b = 'it''s ?' AND c = ?`, `SELECT "what?" FROM t WHERE a = $1 AND b = 'it''s ?' AND c = $2`},
+		{`INSERT INTO unit (unit, parent) VALUES (?, NULLIF(?, ''))`, `INSERT INTO unit (unit, parent) VALUES ($1, NULLIF($2, ''))`},
+	} {
+		if got := rebind(c.query); got != c.want {
+			t.Errorf("rebind(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestTsQuery(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"engine", `'engine':*`},
+		{"  engine  check ", `'engine':* & 'check':*`},
+		{`it's a\b`, `'it''s':* & 'a\\b':*`},
+	} {
+		if got := tsQuery(c.text); got != c.want {
+			t.Errorf("tsQuery(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
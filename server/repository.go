@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/models"
+)
+
+//------------------------ REPOSITORY ----------------------------------------------//
+// Everything the server keeps is read and written through these interfaces, so that handlers work the same
+// whichever database the server runs on. Every implementation reports a missing row as sql.ErrNoRows.
+type UserRepository interface {
+	GetUser(id string) (models.User, error)
+	// The user with the username in any case, usernames are unique
+	GetCredentials(username string) (userCredentials, error)
+	// Lists a page of the normal users within the scope of the admin along with the total number of matching users
+	ListUsers(admin string, filter userFilter, page pageRequest) ([]models.User, int, string, error)
+	// Lists the ids of the active normal users of the unit and every unit below it
+	ListUnitUsers(unit string) ([]string, error)
+	CreateUser(user models.User, passwordHash string) error
+	// Replaces the profile, type, unit and active state of the user, the password is kept when no hash is given
+	UpdateUser(user models.User, passwordHash string) error
+	SetUserActive(id string, active bool) error
+	// Whether the user belongs to the unit of the admin or one of the units below it
+	UserInScope(admin string, user string) (bool, error)
+	UnitInScope(admin string, unit string) (bool, error)
+}
+
+type TaskRepository interface {
+	GetTask(id string) (models.Task, error)
+	// Lists a page of the tasks visible to the user along with the total number of matching tasks
+	ListTasks(uid string, utype string, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error)
+	// Creates either all of the tasks or none of them, each with the first event of its history
+	CreateTasks(tasks []models.Task) error
+	// Saves the new state of a task and records what the actor changed in its history
+	UpdateTask(actor string, before models.Task, after models.Task) error
+	// The comments of a task, oldest first, along with the names of their authors
+	ListComments(task string) ([]models.Comment, error)
+	CreateComment(comment models.Comment) error
+	// The attachments of a task, oldest first
+	ListAttachments(task string) ([]models.Attachment, error)
+	// An attachment of the task, one that belongs to another task is reported as missing
+	GetAttachment(task string, id string) (models.Attachment, error)
+	CreateAttachment(attachment models.Attachment) error
+	// The history of a task, oldest first, which is kept once the task is deleted
+	ListTaskEvents(task string) ([]models.TaskEvent, error)
+	// The latest events of the tasks of the normal users within the scope of the admin, newest first
+	ListAuditEvents(admin string, limit int) ([]models.TaskEvent, error)
+	// Removes a task along with its tags, comments and attachments, which are returned so that their files can be removed
+	DeleteTask(actor string, task models.Task) ([]models.Attachment, error)
+}
+
+type UnitRepository interface {
+	GetUnit(id string) (models.Unit, error)
+	// The unit of the admin and every unit below it
+	ListUnits(admin string) ([]models.Unit, error)
+	CreateUnit(unit models.Unit) error
+	// Renames the unit and places it, along with everything below it, under its parent
+	UpdateUnit(unit models.Unit) error
+}
+
+type InviteRepository interface {
+	// The invites for the units within the scope of the admin, newest first
+	ListInvites(admin string) ([]models.Invite, error)
+	GetInvite(code string) (models.Invite, error)
+	CreateInvite(invite models.Invite) error
+	// Removes an invite which has not been used yet
+	DeleteInvite(code string) error
+	// Creates the user and claims the invite for them at once, so that an invite can only be used once
+	RegisterUser(code string, user models.User, passwordHash string, usedAt time.Time) error
+}
+
+type SessionRepository interface {
+	CreateSession(session session) error
+	// The session of the hash of a refresh token
+	GetSession(tokenHash string) (session, error)
+	// Revokes the session in favour of the next one, unless it has been revoked already
+	RotateSession(tokenHash string, next session, revokedAt time.Time) error
+	RevokeSession(tokenHash string, revokedAt time.Time) error
+	// Ends every session of the user that has not been revoked yet
+	RevokeUserSessions(user string, revokedAt time.Time) error
+}
+
+type ScheduleRepository interface {
+	GetTemplate(id string) (models.Template, error)
+	// The templates of the units within the scope of the admin, by name
+	ListTemplates(admin string) ([]models.Template, error)
+	CreateTemplate(template models.Template) error
+	// Removes a template along with every schedule that was using it, the tasks created from it are kept
+	DeleteTemplate(id string) error
+	GetSchedule(id string) (models.Schedule, error)
+	// The schedules using the templates within the scope of the admin, next to run first
+	ListSchedules(admin string) ([]models.Schedule, error)
+	CreateSchedule(schedule models.Schedule) error
+	// Stops a schedule, it is kept so that its past runs can still be traced
+	StopSchedule(id string) error
+	// The active schedules whose next run is at or before now
+	ListDueSchedules(now time.Time) ([]models.Schedule, error)
+	// Records the due run of the schedule and moves it on to nextRun, a zero time stopping it. The tasks are only
+	// created when the run has not been recorded before, so that a run is never materialised twice.
+	RunSchedule(schedule models.Schedule, tasks []models.Task, nextRun time.Time, now time.Time) error
+}
+
+type Repository interface {
+	UserRepository
+	TaskRepository
+	UnitRepository
+	InviteRepository
+	SessionRepository
+	ScheduleRepository
+}
+
+// A user along with the hash of their password, only ever read to log in
+type userCredentials struct {
+	models.User
+	PasswordHash string
+}
+
+// A session started by logging in, only the hash of its refresh token is stored
+type session struct {
+	TokenHash string
+	User      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+type userFilter struct {
+	Search          string
+	IncludeInactive bool
+	Sort            string
+	Descending      bool
+}
+
+// The repository of the server, opened from DATABASE_URL in main
+var repo Repository
+
+// Keeps everything in a SQL database, queries are written once and the dialect covers what differs
+type sqlRepository struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+var _ Repository = (*sqlRepository)(nil)
+
+// A paginated listing of a sqlRepository. The count is read from From, the rows from From and Joins,
+// both filtered by Where and ordered on SortKey with IdColumn breaking ties.
+type listQuery struct {
+	Columns    string
+	From       string
+	Joins      string
+	Where      string
+	Args       []interface{}
+	SortKey    string
+	IdColumn   string
+	Descending bool
+}
+
+// Collects the rows of a page in the order they are read. Listings read one row more than the limit, which
+// only tells that there is another page, starting after the last row added.
+type pager struct {
+	page pageRequest
+	rows int
+	last pageCursor
+	// The total ignores the cursor so that it stays the same across pages
+	Total int
+	Next  string
+}
+
+// Reports whether another row fits in the page, once it is full the row that doesn't fit sets the next cursor
+func (p *pager) fits() bool {
+	if p.rows < p.page.Limit {
+		return true
+	}
+
+	p.Next = encodeCursor(p.last)
+	return false
+}
+
+func (p *pager) add(key string, id string) {
+	p.rows++
+	p.last = pageCursor{Key: key, Id: id}
+}
+
+// Counts the rows of the listing and reads those of the page with scan, which returns the sort key and id of the row
+func (s *sqlRepository) listPage(q listQuery, page pageRequest, scan func(rows *sql.Rows) (string, string, error)) (pager, error) {
+	p := pager{page: page}
+
+	sql := `SELECT COUNT(*)` + q.From + q.Where
+	if err := s.db.QueryRow(sql, q.Args...).Scan(&p.Total); err != nil {
+		return p, err
+	}
+
+	args := append([]interface{}{}, q.Args...)
+	sql = `SELECT ` + q.Columns + `, ` + q.SortKey + q.From + q.Joins + q.Where
+	addPage(&sql, &args, page, q.SortKey, q.IdColumn, q.Descending)
+
+	results, err := s.db.Query(sql, args...)
+	if err != nil {
+		return p, err
+	}
+
+	defer results.Close()
+
+	for results.Next() && p.fits() {
+		key, id, err := scan(results)
+		if err != nil {
+			return p, err
+		}
+		p.add(key, id)
+	}
+
+	return p, results.Err()
+}
+
+// Continues after the cursor and orders on the sort key with the id column breaking ties.
+// A row more than the limit is selected so that the caller knows whether there is a next page.
+func addPage(sql *string, args *[]interface{}, page pageRequest, key string, id string, descending bool) {
+	op, order := ">", "ASC"
+	if descending {
+		op, order = "<", "DESC"
+	}
+
+	if page.Cursor != nil {
+		*sql += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND %s %s ?))", key, op, key, id, op)
+		*args = append(*args, page.Cursor.Key, page.Cursor.Key, page.Cursor.Id)
+	}
+
+	*sql += fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT ?", key, order, id, order)
+	*args = append(*args, page.Limit+1)
+}
+
+// Selects the unit of an admin and every unit below it, the admin user id is the only argument
+const adminScopeCTE = `WITH RECURSIVE scope(unit) AS (
+	SELECT admin.unit FROM "user" AS admin WHERE admin."user" = ? AND admin.type = 'admin'
+	UNION ALL
+	SELECT unit.unit FROM unit INNER JOIN scope ON unit.parent = scope.unit
+)`
+
+// Restricts a query on the user table to the users within the unit subtree of the admin
+func addScopeFilter(sql *string, args *[]interface{}, uid string) {
+	*sql += `"user".unit IN (` + adminScopeCTE + ` SELECT unit FROM scope)`
+	*args = append(*args, uid)
+}
+
+// What differs between the SQL databases the server runs on
+type dialect struct {
+	// Name of the migrations written for the database, see the migrate package
+	Name string
+	// Joins the values of a text column into a single comma separated value
+	GroupConcat func(column string) string
+	// Restricts a query on the task table to the tasks whose name or comments match the search
+	AddTaskSearch func(sql *string, args *[]interface{}, search string)
+}
+
+// Opens the database named by DATABASE_URL. postgres:// and postgresql:// URLs are served by PostgreSQL,
+// anything else is the path of a SQLite file, optionally prefixed with sqlite://
+func openDatabase(url string) (*sql.DB, dialect, error) {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		db, err := openPostgres(url)
+		return db, postgresDialect, err
+	}
+
+	db, err := sql.Open("sqlite3", strings.TrimPrefix(url, "sqlite://"))
+	if err != nil {
+		return nil, sqliteDialect, err
+	}
+
+	// Without FTS5 the task search migration fails with a bare "no such module: fts5", say how to build instead
+	fts5, err := hasFTS5(db)
+	if err != nil {
+		db.Close()
+		return nil, sqliteDialect, err
+	}
+	if !fts5 {
+		db.Close()
+		return nil, sqliteDialect, errors.New("SQLite was built without FTS5, build the server with go build -tags sqlite_fts5")
+	}
+
+	return db, sqliteDialect, nil
+}
+
+// The SQLite driver only includes FTS5 when built with the sqlite_fts5 tag
+func hasFTS5(db *sql.DB) (bool, error) {
+	var fts5 bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5)
+	return fts5, err
+}
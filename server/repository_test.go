@@ -0,0 +1,843 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"server/migrate"
+	"server/models"
+)
+
+//------------------------ REPOSITORY CONFORMANCE ----------------------------------//
+// Every repository runs the same tests, so that the in-memory one behind the handler tests behaves like the
+// databases. PostgreSQL is only tested when POSTGRES_TEST_URL names a database the tests may create schemas in,
+// and SQLite when the tests are built with the sqlite_fts5 tag that the task search needs.
+func forEachRepository(t *testing.T, test func(t *testing.T, f Repository)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryRepository())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		if fts5, err := hasFTS5(db); err != nil {
+			t.Fatal(err)
+		} else if !fts5 {
+			t.Skip("SQLite was built without FTS5, run go test -tags sqlite_fts5 ./... to include it")
+		}
+
+		test(t, openSQLRepository(t, db, sqliteDialect))
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("POSTGRES_TEST_URL")
+		if dsn == "" {
+			t.Skip("POSTGRES_TEST_URL is not set")
+		}
+
+		test(t, openSQLRepository(t, openPostgresSchema(t, dsn), postgresDialect))
+	})
+}
+
+// Brings a new database up to date with the migrations of the dialect
+func openSQLRepository(t *testing.T, db *sql.DB, d dialect) Repository {
+	if _, err := migrate.Up(db, d.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	return &sqlRepository{db: db, dialect: d}
+}
+
+// Every test gets a schema of its own, which is dropped once it is done
+func openPostgresSchema(t *testing.T, dsn string) *sql.DB {
+	admin, err := openPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("conformance_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	db, err := openPostgres(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// Sets up amb > dep1 > plt1 and amb > dep2, with an admin at amb and dep1 and normal users below them.
+// n3 has been deactivated.
+func seedRepository(t *testing.T, f Repository) {
+	for _, unit := range []models.Unit{
+		{Id: "amb", Name: "1 AMB", Level: "amb"},
+		{Id: "dep1", Name: "Depot 1", Level: "depot", Parent: "amb"},
+		{Id: "plt1", Name: "Platoon 1", Level: "platoon", Parent: "dep1"},
+		{Id: "dep2", Name: "Depot 2", Level: "depot", Parent: "amb"},
+	} {
+		if err := f.CreateUnit(unit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, user := range []models.User{
+		{Id: "adm", Username: "adm", Utype: "admin", Unit: "amb", Man: -1, FirstName: "Amb", LastName: "Admin", Rank: "CPT", Active: true},
+		{Id: "adm1", Username: "adm1", Utype: "admin", Unit: "dep1", Man: -1, FirstName: "Depot", LastName: "Admin", Rank: "LTA", Active: true},
+		{Id: "n1", Username: "n1", Utype: "normal", Unit: "plt1", Man: 1, FirstName: "Ann", LastName: "Alpha", Rank: "CPL", Active: true},
+		{Id: "n2", Username: "n2", Utype: "normal", Unit: "dep2", Man: 2, FirstName: "Ben", LastName: "Bravo", Rank: "PTE", Active: true},
+		{Id: "n3", Username: "n3", Utype: "normal", Unit: "plt1", Man: 3, FirstName: "Cal", LastName: "Charlie", Rank: "PTE", Active: false},
+	} {
+		if err := f.CreateUser(user, "hash-"+user.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seedTasks(t *testing.T, f Repository) {
+	now := time.Now().UTC().Truncate(time.Second)
+	past := now.Add(-48 * time.Hour)
+	future := now.Add(48 * time.Hour)
+
+	tasks := []models.Task{
+		{Id: "t1", Name: "Alpha inspection", AssignedTo: "n1", AssignedBy: "adm1", Status: "assigned", Priority: "high", Category: "Vehicles",
+			Tags: []string{"engine", "weekly"}, CreatedAt: now.Add(-3 * time.Hour), DueAt: &future, Version: 1, UpdatedAt: now},
+		{Id: "t2", Name: "Bravo stocktake", AssignedTo: "n2", AssignedBy: "adm", Status: "assigned", Priority: "low", Category: "stores",
+			CreatedAt: now.Add(-2 * time.Hour), DueAt: &past, Version: 1, UpdatedAt: now},
+		{Id: "t3", Name: "Charlie cleanup", AssignedTo: "n1", AssignedBy: "adm", Status: "assigned", Priority: "normal",
+			Tags: []string{"weekly"}, CreatedAt: now.Add(-1 * time.Hour), DueAt: &past, Version: 1, UpdatedAt: now},
+	}
+
+	if err := f.CreateTasks(tasks); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func taskIds(tasks []models.Task) []string {
+	ids := []string{}
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+	return ids
+}
+
+func userIds(users []models.User) []string {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
+
+func errorStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	return toAPIError(err).Status
+}
+
+func TestRepositoryUsers(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		user, err := f.GetUser("n1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := models.User{Id: "n1", Username: "n1", Utype: "normal", Unit: "plt1", Man: 1, FirstName: "Ann", LastName: "Alpha", Rank: "CPL", Active: true}
+		if user != want {
+			t.Errorf("GetUser = %+v, want %+v", user, want)
+		}
+
+		if _, err := f.GetUser("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetUser of a missing user = %v, want sql.ErrNoRows", err)
+		}
+
+		// Usernames are compared in lower case, however they were stored
+		duplicate := models.User{Id: "n9", Username: "n1", Utype: "normal", Unit: "plt1", Rank: "PTE", Active: true}
+		if status := errorStatus(f.CreateUser(duplicate, "hash")); status != http.StatusConflict {
+			t.Errorf("CreateUser with a taken username gave status %d, want 409", status)
+		}
+
+		credentials, err := f.GetCredentials("n1")
+		if err != nil || credentials.Id != "n1" || credentials.PasswordHash != "hash-n1" {
+			t.Errorf("GetCredentials = %+v, %v", credentials, err)
+		}
+		if _, err := f.GetCredentials("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetCredentials of a missing user = %v, want sql.ErrNoRows", err)
+		}
+
+		// The password is kept unless a new hash is given
+		user.FirstName = "Anne"
+		user.Unit = "dep1"
+		if err := f.UpdateUser(user, ""); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := f.GetUser("n1"); got.FirstName != "Anne" || got.Unit != "dep1" {
+			t.Errorf("GetUser after UpdateUser = %+v", got)
+		}
+		if credentials, _ := f.GetCredentials("n1"); credentials.PasswordHash != "hash-n1" {
+			t.Errorf("UpdateUser without a hash changed the password: %+v", credentials)
+		}
+		if err := f.UpdateUser(user, "new-hash"); err != nil {
+			t.Fatal(err)
+		}
+		if credentials, _ := f.GetCredentials("n1"); credentials.PasswordHash != "new-hash" {
+			t.Errorf("UpdateUser with a hash kept the password: %+v", credentials)
+		}
+
+		if err := f.SetUserActive("n2", false); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := f.GetUser("n2"); got.Active {
+			t.Errorf("SetUserActive(false) left the user active")
+		}
+	})
+}
+
+func TestRepositoryScope(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		for _, c := range []struct {
+			admin, user string
+			want        bool
+		}{
+			{"adm", "n1", true},
+			{"adm", "n2", true},
+			{"adm", "adm1", true},
+			{"adm1", "n1", true},
+			{"adm1", "n2", false},
+			{"adm1", "adm", false},
+			// Only admins have a scope
+			{"n1", "n1", false},
+		} {
+			got, err := f.UserInScope(c.admin, c.user)
+			if err != nil || got != c.want {
+				t.Errorf("UserInScope(%s, %s) = %v, %v, want %v", c.admin, c.user, got, err, c.want)
+			}
+		}
+
+		for _, c := range []struct {
+			admin, unit string
+			want        bool
+		}{
+			{"adm", "amb", true},
+			{"adm", "dep2", true},
+			{"adm1", "dep1", true},
+			{"adm1", "plt1", true},
+			{"adm1", "dep2", false},
+			{"adm1", "amb", false},
+			{"adm1", "missing", false},
+		} {
+			got, err := f.UnitInScope(c.admin, c.unit)
+			if err != nil || got != c.want {
+				t.Errorf("UnitInScope(%s, %s) = %v, %v, want %v", c.admin, c.unit, got, err, c.want)
+			}
+		}
+
+		// Deactivated users are left out
+		users, err := f.ListUnitUsers("dep1")
+		sort.Strings(users)
+		if err != nil || !reflect.DeepEqual(users, []string{"n1"}) {
+			t.Errorf("ListUnitUsers(dep1) = %v, %v", users, err)
+		}
+	})
+}
+
+func TestRepositoryListUsers(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		for _, c := range []struct {
+			name   string
+			admin  string
+			filter userFilter
+			want   []string
+		}{
+			{"normal users in scope", "adm", userFilter{Sort: "username"}, []string{"n1", "n2"}},
+			{"narrower scope", "adm1", userFilter{Sort: "username"}, []string{"n1"}},
+			{"inactive included", "adm", userFilter{Sort: "username", IncludeInactive: true}, []string{"n1", "n2", "n3"}},
+			{"descending", "adm", userFilter{Sort: "username", Descending: true}, []string{"n2", "n1"}},
+			{"sorted on name", "adm", userFilter{Sort: "name", IncludeInactive: true}, []string{"n1", "n2", "n3"}},
+			{"search", "adm", userFilter{Sort: "username", Search: "BRA"}, []string{"n2"}},
+		} {
+			users, total, next, err := f.ListUsers(c.admin, c.filter, pageRequest{Limit: 10})
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if got := userIds(users); !reflect.DeepEqual(got, c.want) || total != len(c.want) || next != "" {
+				t.Errorf("%s: ListUsers = %v (total %d, next %q), want %v", c.name, got, total, next, c.want)
+			}
+		}
+
+		// Pages continue after the cursor and keep the same total
+		var got []string
+		page := pageRequest{Limit: 2}
+		for i := 0; i < 3; i++ {
+			users, total, next, err := f.ListUsers("adm", userFilter{Sort: "username", IncludeInactive: true}, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 3 {
+				t.Errorf("page %d has total %d, want 3", i, total)
+			}
+			got = append(got, userIds(users)...)
+			if next == "" {
+				break
+			}
+			page.Cursor = decodeTestCursor(t, next)
+		}
+		if !reflect.DeepEqual(got, []string{"n1", "n2", "n3"}) {
+			t.Errorf("paging through the users gave %v", got)
+		}
+	})
+}
+
+func decodeTestCursor(t *testing.T, cursor string) *pageCursor {
+	r, _ := http.NewRequest("GET", "/?cursor="+cursor, nil)
+	page, err := parsePage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page.Cursor
+}
+
+func TestRepositoryTasks(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+		seedTasks(t, f)
+
+		task, err := f.GetTask("t1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(task.Tags)
+		if task.Name != "Alpha inspection" || task.AssignedTo != "n1" || task.AssignedBy != "adm1" || task.Status != "assigned" ||
+			task.Priority != "high" || task.Category != "Vehicles" || !reflect.DeepEqual(task.Tags, []string{"engine", "weekly"}) ||
+			task.Version != 1 || task.DueAt == nil {
+			t.Errorf("GetTask = %+v", task)
+		}
+		if task.Assignee == nil || *task.Assignee != (models.UserRef{Id: "n1", Rank: "CPL", FirstName: "Ann", LastName: "Alpha"}) {
+			t.Errorf("GetTask assignee = %+v", task.Assignee)
+		}
+		if task.Assigner == nil || task.Assigner.Id != "adm1" || task.Verifier != nil {
+			t.Errorf("GetTask assigner = %+v, verifier = %+v", task.Assigner, task.Verifier)
+		}
+
+		if _, err := f.GetTask("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetTask of a missing task = %v, want sql.ErrNoRows", err)
+		}
+
+		// A task with a taken id fails the whole batch
+		if err := f.CreateTasks([]models.Task{{Id: "t4", Name: "New", AssignedTo: "n1", AssignedBy: "adm", Status: "assigned", Priority: "normal", CreatedAt: time.Now().UTC()},
+			{Id: "t1", Name: "Again", AssignedTo: "n1", AssignedBy: "adm", Status: "assigned", Priority: "normal", CreatedAt: time.Now().UTC()}}); err == nil {
+			t.Errorf("CreateTasks with a taken id succeeded")
+		}
+		if _, err := f.GetTask("t4"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("CreateTasks kept part of a failed batch: %v", err)
+		}
+	})
+}
+
+func TestRepositoryListTasks(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+		seedTasks(t, f)
+
+		for _, c := range []struct {
+			name   string
+			uid    string
+			utype  string
+			due    dueFilter
+			filter taskFilter
+			want   []string
+		}{
+			{"own tasks", "n1", "normal", dueFilter{}, taskFilter{Sort: "created_at"}, []string{"t1", "t3"}},
+			{"admin scope", "adm1", "admin", dueFilter{}, taskFilter{Sort: "created_at"}, []string{"t1", "t3"}},
+			{"wider admin scope", "adm", "admin", dueFilter{}, taskFilter{Sort: "created_at"}, []string{"t1", "t2", "t3"}},
+			{"assignee", "adm", "admin", dueFilter{}, taskFilter{Sort: "created_at", AssignedTo: "n2"}, []string{"t2"}},
+			{"priorities", "adm", "admin", dueFilter{}, taskFilter{Sort: "created_at", Priorities: []string{"high", "low"}}, []string{"t1", "t2"}},
+			{"category", "adm", "admin", dueFilter{}, taskFilter{Sort: "created_at", Category: "vehicles"}, []string{"t1"}},
+			{"tags", "adm", "admin", dueFilter{}, taskFilter{Sort: "created_at", Tags: []string{"weekly"}}, []string{"t1", "t3"}},
+			{"search", "adm", "admin", dueFilter{}, taskFilter{Sort: "created_at", Search: "insp"}, []string{"t1"}},
+			{"overdue", "adm", "admin", dueFilter{Overdue: true}, taskFilter{Sort: "created_at"}, []string{"t2", "t3"}},
+			{"due within", "adm", "admin", dueFilter{DueWithin: 7}, taskFilter{Sort: "created_at"}, []string{"t1"}},
+			{"sorted on priority", "adm", "admin", dueFilter{}, taskFilter{Sort: "priority", Descending: true}, []string{"t1", "t3", "t2"}},
+			{"sorted on name", "adm", "admin", dueFilter{}, taskFilter{Sort: "name"}, []string{"t1", "t2", "t3"}},
+		} {
+			tasks, total, next, err := f.ListTasks(c.uid, c.utype, c.due, c.filter, pageRequest{Limit: 10})
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if got := taskIds(tasks); !reflect.DeepEqual(got, c.want) || total != len(c.want) || next != "" {
+				t.Errorf("%s: ListTasks = %v (total %d, next %q), want %v", c.name, got, total, next, c.want)
+			}
+		}
+
+		var got []string
+		page := pageRequest{Limit: 1}
+		for i := 0; i < 4; i++ {
+			tasks, total, next, err := f.ListTasks("adm", "admin", dueFilter{}, taskFilter{Sort: "due_at"}, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 3 {
+				t.Errorf("page %d has total %d, want 3", i, total)
+			}
+			got = append(got, taskIds(tasks)...)
+			if next == "" {
+				break
+			}
+			page.Cursor = decodeTestCursor(t, next)
+		}
+		if len(got) != 3 || got[2] != "t1" {
+			t.Errorf("paging through the tasks on due date gave %v", got)
+		}
+	})
+}
+
+func TestRepositoryUpdateDeleteTask(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+		seedTasks(t, f)
+
+		before, err := f.GetTask("t1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after := before
+		after.Name = "Alpha inspection, done"
+		after.Status = "in_progress"
+		after.Tags = []string{"monthly"}
+		after.Version = 2
+		after.UpdatedAt = time.Now().UTC()
+		if err := f.UpdateTask("n1", before, after); err != nil {
+			t.Fatal(err)
+		}
+
+		task, err := f.GetTask("t1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Name != after.Name || task.Status != "in_progress" || task.Version != 2 || !reflect.DeepEqual(task.Tags, []string{"monthly"}) {
+			t.Errorf("GetTask after UpdateTask = %+v", task)
+		}
+
+		// The task has moved past the version the update is based on
+		stale := after
+		stale.Name = "Lost update"
+		if status := errorStatus(f.UpdateTask("n1", before, stale)); status != http.StatusPreconditionFailed {
+			t.Errorf("UpdateTask of a stale version gave status %d, want 412", status)
+		}
+
+		if attachments, err := f.ListAttachments("t1"); err != nil || len(attachments) != 0 {
+			t.Errorf("ListAttachments = %v, %v", attachments, err)
+		}
+
+		if _, err := f.DeleteTask("adm1", task); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.GetTask("t1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetTask after DeleteTask = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestRepositoryTaskActivity(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+		seedTasks(t, f)
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for i, comment := range []models.Comment{
+			{Id: "c1", TaskId: "t1", Author: "n1", Body: "Started", CreatedAt: now},
+			{Id: "c2", TaskId: "t1", Author: "adm1", Body: "Thanks", CreatedAt: now.Add(time.Minute)},
+			{Id: "c3", TaskId: "t2", Author: "n2", Body: "Elsewhere", CreatedAt: now},
+		} {
+			if err := f.CreateComment(comment); err != nil {
+				t.Fatalf("CreateComment %d: %v", i, err)
+			}
+		}
+
+		comments, err := f.ListComments("t1")
+		if err != nil || len(comments) != 2 {
+			t.Fatalf("ListComments = %+v, %v", comments, err)
+		}
+		if comments[0].Id != "c1" || comments[0].AuthorName != "CPL Ann Alpha" || comments[1].AuthorName != "LTA Depot Admin" {
+			t.Errorf("ListComments = %+v", comments)
+		}
+
+		attachment := models.Attachment{Id: "a1", TaskId: "t1", UploadedBy: "n1", Filename: "photo.png", ContentType: "image/png", Size: 42, CreatedAt: now}
+		if err := f.CreateAttachment(attachment); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := f.GetAttachment("t1", "a1"); err != nil || got.Filename != "photo.png" || got.Size != 42 || got.UploadedBy != "n1" {
+			t.Errorf("GetAttachment = %+v, %v", got, err)
+		}
+
+		// An attachment is only found through the task it belongs to
+		if _, err := f.GetAttachment("t2", "a1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetAttachment through another task = %v, want sql.ErrNoRows", err)
+		}
+
+		if attachments, err := f.ListAttachments("t1"); err != nil || len(attachments) != 1 || attachments[0].Id != "a1" {
+			t.Errorf("ListAttachments = %+v, %v", attachments, err)
+		}
+
+		before, err := f.GetTask("t1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := before
+		after.Status = "in_progress"
+		after.Version = 2
+		if err := f.UpdateTask("n1", before, after); err != nil {
+			t.Fatal(err)
+		}
+
+		removed, err := f.DeleteTask("adm1", after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 1 || removed[0].Id != "a1" {
+			t.Errorf("DeleteTask returned the attachments %+v, want a1", removed)
+		}
+
+		if comments, err := f.ListComments("t1"); err != nil || len(comments) != 0 {
+			t.Errorf("ListComments after DeleteTask = %+v, %v", comments, err)
+		}
+		if _, err := f.GetAttachment("t1", "a1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetAttachment after DeleteTask = %v, want sql.ErrNoRows", err)
+		}
+
+		// The history outlives the task
+		events, err := f.ListTaskEvents("t1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, event := range events {
+			actions = append(actions, event.Actor+":"+event.Action)
+		}
+		if want := []string{"adm1:create", "n1:update", "adm1:delete"}; !reflect.DeepEqual(actions, want) {
+			t.Errorf("ListTaskEvents = %v, want %v", actions, want)
+		}
+		if change := events[1].Changes["status"]; change.From != "assigned" || change.To != "in_progress" {
+			t.Errorf("the update recorded %+v for the status", change)
+		}
+
+		// The audit feed only covers the tasks of the users within the admin's scope, newest first
+		for _, c := range []struct {
+			admin string
+			limit int
+			want  int
+			first string
+		}{
+			{"adm", 100, 5, "adm1:delete"},
+			{"adm", 2, 2, "adm1:delete"},
+			{"adm1", 100, 4, "adm1:delete"},
+			{"n1", 100, 0, ""},
+		} {
+			feed, err := f.ListAuditEvents(c.admin, c.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(feed) != c.want || (c.want > 0 && feed[0].Actor+":"+feed[0].Action != c.first) {
+				t.Errorf("ListAuditEvents(%s, %d) gave %d events starting with %+v", c.admin, c.limit, len(feed), feed)
+			}
+		}
+	})
+}
+
+func TestRepositoryUnits(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		unit, err := f.GetUnit("plt1")
+		if want := (models.Unit{Id: "plt1", Name: "Platoon 1", Level: "platoon", Parent: "dep1"}); err != nil || unit != want {
+			t.Errorf("GetUnit = %+v, %v, want %+v", unit, err, want)
+		}
+
+		if _, err := f.GetUnit("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetUnit of a missing unit = %v, want sql.ErrNoRows", err)
+		}
+
+		// Moving a unit takes everything below it along
+		unit.Name = "Platoon One"
+		unit.Parent = "dep2"
+		if err := f.UpdateUnit(unit); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			admin string
+			want  []string
+		}{
+			{"adm", []string{"amb", "dep1", "dep2", "plt1"}},
+			{"adm1", []string{"dep1"}},
+			{"n1", []string{}},
+		} {
+			units, err := f.ListUnits(c.admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []string{}
+			for _, unit := range units {
+				ids = append(ids, unit.Id)
+			}
+			if !reflect.DeepEqual(ids, c.want) {
+				t.Errorf("ListUnits(%s) = %v, want %v", c.admin, ids, c.want)
+			}
+		}
+
+		if inScope, err := f.UserInScope("adm1", "n1"); err != nil || inScope {
+			t.Errorf("UserInScope(adm1, n1) after moving plt1 = %v, %v, want false", inScope, err)
+		}
+	})
+}
+
+func TestRepositoryInvites(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, invite := range []models.Invite{
+			{Code: "i1", Type: "normal", Unit: "plt1", CreatedBy: "adm1", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.AddDate(0, 0, 7)},
+			{Code: "i2", Type: "normal", Unit: "dep2", CreatedBy: "adm", CreatedAt: now, ExpiresAt: now.AddDate(0, 0, 7)},
+			{Code: "i3", Type: "admin", Unit: "dep1", CreatedBy: "adm", CreatedAt: now.Add(time.Hour), ExpiresAt: now.AddDate(0, 0, 7)},
+		} {
+			if err := f.CreateInvite(invite); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		codes := func(admin string) []string {
+			invites, err := f.ListInvites(admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			codes := []string{}
+			for _, invite := range invites {
+				codes = append(codes, invite.Code)
+			}
+			return codes
+		}
+
+		if got, want := codes("adm"), []string{"i3", "i2", "i1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListInvites(adm) = %v, want %v", got, want)
+		}
+		if got, want := codes("adm1"), []string{"i3", "i1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListInvites(adm1) = %v, want %v", got, want)
+		}
+
+		user := models.User{Id: "n4", Username: "n4", Utype: "normal", Unit: "plt1", Rank: "PTE", Active: true}
+		if err := f.RegisterUser("i1", user, "hash-n4", now); err != nil {
+			t.Fatal(err)
+		}
+
+		invite, err := f.GetInvite("i1")
+		if err != nil || invite.UsedBy != "n4" || invite.UsedAt == nil {
+			t.Errorf("GetInvite after RegisterUser = %+v, %v", invite, err)
+		}
+		if _, err := f.GetUser("n4"); err != nil {
+			t.Errorf("GetUser of the registered user = %v", err)
+		}
+
+		// An invite can only be used once, and the user is not created when it has been
+		again := models.User{Id: "n5", Username: "n5", Utype: "normal", Unit: "plt1", Rank: "PTE", Active: true}
+		if status := errorStatus(f.RegisterUser("i1", again, "hash-n5", now)); status != http.StatusForbidden {
+			t.Errorf("RegisterUser with a used invite gave status %d, want 403", status)
+		}
+		if _, err := f.GetUser("n5"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetUser of a user registered with a used invite = %v, want sql.ErrNoRows", err)
+		}
+
+		// Used invites are kept
+		for _, code := range []string{"i1", "i2"} {
+			if err := f.DeleteInvite(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, want := codes("adm"), []string{"i3", "i1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListInvites(adm) after DeleteInvite = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestRepositorySessions(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		now := time.Now().UTC().Truncate(time.Second)
+		newTestSession := func(hash string, user string) session {
+			return session{TokenHash: hash, User: user, CreatedAt: now, ExpiresAt: now.Add(refreshTokenTTL)}
+		}
+
+		for _, s := range []session{newTestSession("s1", "n1"), newTestSession("s2", "n1"), newTestSession("s3", "n2")} {
+			if err := f.CreateSession(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		current, err := f.GetSession("s1")
+		if err != nil || current.User != "n1" || !current.ExpiresAt.Equal(now.Add(refreshTokenTTL)) || current.RevokedAt != nil {
+			t.Errorf("GetSession = %+v, %v", current, err)
+		}
+
+		if _, err := f.GetSession("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetSession of a missing session = %v, want sql.ErrNoRows", err)
+		}
+
+		if err := f.RotateSession("s1", newTestSession("s4", "n1"), now); err != nil {
+			t.Fatal(err)
+		}
+
+		// A session can only be rotated once
+		if status := errorStatus(f.RotateSession("s1", newTestSession("s5", "n1"), now)); status != http.StatusUnauthorized {
+			t.Errorf("RotateSession of a revoked session gave status %d, want 401", status)
+		}
+		if _, err := f.GetSession("s5"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetSession of the session of a failed rotation = %v, want sql.ErrNoRows", err)
+		}
+
+		if err := f.RevokeUserSessions("n1", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.RevokeSession("s3", now); err != nil {
+			t.Fatal(err)
+		}
+
+		for hash, revoked := range map[string]bool{"s1": true, "s2": true, "s3": true, "s4": true} {
+			current, err := f.GetSession(hash)
+			if err != nil || (current.RevokedAt != nil) != revoked {
+				t.Errorf("GetSession(%s) = %+v, %v, want revoked %v", hash, current, err, revoked)
+			}
+		}
+	})
+}
+
+func TestRepositorySchedules(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, f Repository) {
+		seedRepository(t, f)
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, template := range []models.Template{
+			{Id: "tp1", Name: "Weekly check", DueInDays: 2, Unit: "dep1", CreatedBy: "adm1", CreatedAt: now},
+			{Id: "tp2", Name: "Audit", Unit: "amb", CreatedBy: "adm", CreatedAt: now},
+		} {
+			if err := f.CreateTemplate(template); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if template, err := f.GetTemplate("tp1"); err != nil || template.Name != "Weekly check" || template.DueInDays != 2 || template.Unit != "dep1" {
+			t.Errorf("GetTemplate = %+v, %v", template, err)
+		}
+
+		templates, err := f.ListTemplates("adm")
+		if err != nil || len(templates) != 2 || templates[0].Id != "tp2" {
+			t.Errorf("ListTemplates(adm) = %+v, %v", templates, err)
+		}
+		if templates, err := f.ListTemplates("adm1"); err != nil || len(templates) != 1 || templates[0].Id != "tp1" {
+			t.Errorf("ListTemplates(adm1) = %+v, %v", templates, err)
+		}
+
+		due := now.Add(-time.Minute)
+		for _, schedule := range []models.Schedule{
+			{Id: "s1", Template: "tp1", Rule: "0 6 * * 1", AssignedTo: "n1", CreatedBy: "adm1", CreatedAt: now, NextRun: due, Active: true},
+			{Id: "s2", Template: "tp2", Rule: "0 6 1 * *", Unit: "amb", CreatedBy: "adm", CreatedAt: now, NextRun: now.Add(time.Hour), Active: true},
+			{Id: "s3", Template: "tp2", Rule: "0 6 1 * *", Unit: "dep2", CreatedBy: "adm", CreatedAt: now, NextRun: due.Add(-time.Minute), Active: true},
+		} {
+			if err := f.CreateSchedule(schedule); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if schedule, err := f.GetSchedule("s1"); err != nil || schedule.AssignedTo != "n1" || schedule.Unit != "" || !schedule.NextRun.Equal(due) {
+			t.Errorf("GetSchedule = %+v, %v", schedule, err)
+		}
+
+		schedules, err := f.ListSchedules("adm1")
+		if err != nil || len(schedules) != 1 || schedules[0].Id != "s1" {
+			t.Errorf("ListSchedules(adm1) = %+v, %v", schedules, err)
+		}
+
+		if err := f.StopSchedule("s3"); err != nil {
+			t.Fatal(err)
+		}
+
+		dueSchedules, err := f.ListDueSchedules(now)
+		if err != nil || len(dueSchedules) != 1 || dueSchedules[0].Id != "s1" {
+			t.Fatalf("ListDueSchedules = %+v, %v", dueSchedules, err)
+		}
+
+		// A run only creates its tasks once, however often it is retried
+		next := now.AddDate(0, 0, 7)
+		for i := 0; i < 2; i++ {
+			task := models.Task{Id: fmt.Sprintf("run%d", i), Name: "Weekly check", AssignedTo: "n1", AssignedBy: "adm1", Status: "assigned", Priority: "normal", CreatedAt: now}
+			if err := f.RunSchedule(dueSchedules[0], []models.Task{task}, next, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := f.GetTask("run0"); err != nil {
+			t.Errorf("GetTask of the task of the run = %v", err)
+		}
+		if _, err := f.GetTask("run1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetTask of the task of a repeated run = %v, want sql.ErrNoRows", err)
+		}
+		if schedule, err := f.GetSchedule("s1"); err != nil || !schedule.NextRun.Equal(next) || !schedule.Active {
+			t.Errorf("GetSchedule after RunSchedule = %+v, %v", schedule, err)
+		}
+
+		// A schedule without a next run stops
+		if err := f.RunSchedule(dueSchedules[0], nil, time.Time{}, now); err != nil {
+			t.Fatal(err)
+		}
+		if schedule, err := f.GetSchedule("s1"); err != nil || schedule.Active {
+			t.Errorf("GetSchedule after its last run = %+v, %v", schedule, err)
+		}
+
+		// Deleting a template removes its schedules
+		if err := f.DeleteTemplate("tp2"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.GetTemplate("tp2"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetTemplate after DeleteTemplate = %v, want sql.ErrNoRows", err)
+		}
+		if _, err := f.GetSchedule("s2"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetSchedule of a schedule of a deleted template = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
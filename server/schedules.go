@@ -0,0 +1,161 @@
+package main
+
+import (
+	"time"
+
+	"server/models"
+)
+
+//------------------------ DATA ACCESS (Template) ----------------------------------//
+func (s *sqlRepository) GetTemplate(id string) (models.Template, error) {
+	var template models.Template
+
+	sql := `SELECT task_template, name, due_in_days, unit, created_by, created_at FROM task_template WHERE task_template = ?`
+	err := s.db.QueryRow(sql, id).Scan(&template.Id, &template.Name, &template.DueInDays, &template.Unit, &template.CreatedBy, &template.CreatedAt)
+
+	return template, err
+}
+
+func (s *sqlRepository) ListTemplates(admin string) ([]models.Template, error) {
+	var templates []models.Template
+
+	sql := adminScopeCTE + ` SELECT task_template, name, due_in_days, task_template.unit, created_by, created_at
+	FROM task_template INNER JOIN scope ON scope.unit = task_template.unit ORDER BY name`
+
+	results, err := s.db.Query(sql, admin)
+	if err != nil {
+		return templates, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var template models.Template
+		if err := results.Scan(&template.Id, &template.Name, &template.DueInDays, &template.Unit, &template.CreatedBy, &template.CreatedAt); err != nil {
+			return templates, err
+		}
+		templates = append(templates, template)
+	}
+
+	return templates, results.Err()
+}
+
+func (s *sqlRepository) CreateTemplate(template models.Template) error {
+	sql := `INSERT INTO task_template (task_template, name, due_in_days, unit, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(sql, template.Id, template.Name, template.DueInDays, template.Unit, template.CreatedBy, template.CreatedAt)
+	return err
+}
+
+func (s *sqlRepository) DeleteTemplate(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, sql := range []string{
+		`DELETE FROM task_schedule_run WHERE schedule IN (SELECT task_schedule FROM task_schedule WHERE template = ?)`,
+		`DELETE FROM task_schedule WHERE template = ?`,
+		`DELETE FROM task_template WHERE task_template = ?`,
+	} {
+		if _, err := tx.Exec(sql, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//------------------------ DATA ACCESS (Schedule) ----------------------------------//
+const scheduleColumns = `task_schedule.task_schedule, task_schedule.template, task_schedule.rule,
+	COALESCE(task_schedule.assigned_to, ''), COALESCE(task_schedule.unit, ''), task_schedule.created_by,
+	task_schedule.created_at, task_schedule.next_run, task_schedule.active`
+
+func (s *sqlRepository) querySchedules(sql string, args ...interface{}) ([]models.Schedule, error) {
+	var schedules []models.Schedule
+
+	results, err := s.db.Query(sql, args...)
+	if err != nil {
+		return schedules, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var schedule models.Schedule
+		if err := results.Scan(&schedule.Id, &schedule.Template, &schedule.Rule, &schedule.AssignedTo, &schedule.Unit, &schedule.CreatedBy, &schedule.CreatedAt, &schedule.NextRun, &schedule.Active); err != nil {
+			return schedules, err
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, results.Err()
+}
+
+func (s *sqlRepository) GetSchedule(id string) (models.Schedule, error) {
+	var schedule models.Schedule
+
+	sql := `SELECT ` + scheduleColumns + ` FROM task_schedule WHERE task_schedule.task_schedule = ?`
+	err := s.db.QueryRow(sql, id).Scan(&schedule.Id, &schedule.Template, &schedule.Rule, &schedule.AssignedTo, &schedule.Unit, &schedule.CreatedBy, &schedule.CreatedAt, &schedule.NextRun, &schedule.Active)
+
+	return schedule, err
+}
+
+func (s *sqlRepository) ListSchedules(admin string) ([]models.Schedule, error) {
+	sql := adminScopeCTE + ` SELECT ` + scheduleColumns + `
+	FROM task_schedule INNER JOIN task_template ON task_template.task_template = task_schedule.template
+	INNER JOIN scope ON scope.unit = task_template.unit ORDER BY task_schedule.next_run`
+	return s.querySchedules(sql, admin)
+}
+
+func (s *sqlRepository) CreateSchedule(schedule models.Schedule) error {
+	sql := `INSERT INTO task_schedule (task_schedule, template, rule, assigned_to, unit, created_by, created_at, next_run, active)
+	VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?)`
+	_, err := s.db.Exec(sql, schedule.Id, schedule.Template, schedule.Rule, schedule.AssignedTo, schedule.Unit, schedule.CreatedBy, schedule.CreatedAt, schedule.NextRun, schedule.Active)
+	return err
+}
+
+func (s *sqlRepository) StopSchedule(id string) error {
+	sql := `UPDATE task_schedule SET active = FALSE WHERE task_schedule = ?`
+	_, err := s.db.Exec(sql, id)
+	return err
+}
+
+func (s *sqlRepository) ListDueSchedules(now time.Time) ([]models.Schedule, error) {
+	sql := `SELECT ` + scheduleColumns + ` FROM task_schedule WHERE task_schedule.active = TRUE AND task_schedule.next_run <= ?`
+	return s.querySchedules(sql, now)
+}
+
+// Runs are recorded with the time they were due, which stays the same across restarts
+func (s *sqlRepository) RunSchedule(schedule models.Schedule, tasks []models.Task, nextRun time.Time, now time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	sql := `INSERT INTO task_schedule_run (schedule, run_at, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+	result, err := tx.Exec(sql, schedule.Id, schedule.NextRun, now)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 1 {
+		for _, task := range tasks {
+			if err := insertTask(tx, task); err != nil {
+				return err
+			}
+		}
+	}
+
+	sql = `UPDATE task_schedule SET next_run = ?, active = ? WHERE task_schedule = ?`
+	if _, err := tx.Exec(sql, nextRun, !nextRun.IsZero(), schedule.Id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
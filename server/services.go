@@ -0,0 +1,1661 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lithammer/shortuuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"server/cron"
+	"server/models"
+	"server/storage"
+)
+
+//------------------------ SERVICES ------------------------------------------------//
+// The rules deciding who may do what. Handlers decode the request, call a service on behalf of the principal
+// making it and encode what comes back, so the rules hold whichever route is used.
+type UserService interface {
+	// The user making the request
+	Self(actor principal) (models.User, error)
+	GetUser(actor principal, id string) (models.User, error)
+	ListUsers(actor principal, filter userFilter, page pageRequest) ([]models.User, int, string, error)
+	CreateUser(actor principal, req registerUserRequest) (models.User, error)
+	UpdateUser(actor principal, id string, req updateUserRequest) (models.User, error)
+	DeactivateUser(actor principal, id string) error
+}
+
+type TaskService interface {
+	GetTask(actor principal, id string) (models.Task, error)
+	ListTasks(actor principal, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error)
+	// Lists the tasks assigned to the given user, who has to be the actor or fall under them
+	ListUserTasks(actor principal, user string, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error)
+	CreateTask(actor principal, req createTaskRequest) (models.Task, error)
+	// Users that cannot be assigned are skipped and reported in the per-user results
+	CreateTasks(actor principal, req createTasksRequest) ([]createTasksResult, error)
+	// Applies the changes the actor is allowed to make and moves the task through its status workflow.
+	// A request with a version is refused with 412 when the task is no longer at that version.
+	UpdateTask(actor principal, req updateTaskRequest) (models.Task, error)
+	DeleteTask(actor principal, id string) error
+	// Comments and attachments are open to the same users as the task itself
+	ListComments(actor principal, task string) ([]models.Comment, error)
+	CreateComment(actor principal, task string, req createCommentRequest) (models.Comment, error)
+	ListAttachments(actor principal, task string) ([]models.Attachment, error)
+	// The upload is only read once the actor is allowed to add attachments to the task
+	CreateAttachment(actor principal, task string, read func() (attachmentUpload, error)) (models.Attachment, error)
+	// The attachment along with its file, which the caller has to close
+	GetAttachment(actor principal, task string, id string) (models.Attachment, io.ReadCloser, error)
+	// The history stays readable once the task is deleted, access follows the last assignee
+	TaskHistory(actor principal, task string) ([]models.TaskEvent, error)
+	AuditFeed(actor principal, limit int) ([]models.TaskEvent, error)
+}
+
+// Logging in, registering with an invite and keeping sessions going, on behalf of no one yet
+type SessionService interface {
+	Login(req loginUserRequest) (loginUserResponse, error)
+	Register(req registerUserRequest) (loginUserResponse, error)
+	// Every refresh token can only be used once, presenting one again revokes all sessions of the user
+	Refresh(refreshToken string) (loginUserResponse, error)
+	Logout(refreshToken string) error
+}
+
+// Units and the invites into them, only ever managed by admins within their scope
+type UnitService interface {
+	ListUnits(actor principal) ([]models.Unit, error)
+	CreateUnit(actor principal, req unitRequest) (models.Unit, error)
+	UpdateUnit(actor principal, id string, req unitRequest) (models.Unit, error)
+	ListInvites(actor principal) ([]models.Invite, error)
+	CreateInvite(actor principal, req createInviteRequest) (models.Invite, error)
+	DeleteInvite(actor principal, code string) error
+}
+
+// Task templates and the schedules that assign tasks from them
+type ScheduleService interface {
+	ListTemplates(actor principal) ([]models.Template, error)
+	CreateTemplate(actor principal, req createTemplateRequest) (models.Template, error)
+	DeleteTemplate(actor principal, id string) error
+	ListSchedules(actor principal) ([]models.Schedule, error)
+	CreateSchedule(actor principal, req createScheduleRequest) (models.Schedule, error)
+	StopSchedule(actor principal, id string) error
+	// Runs every schedule that is due at now, one failing schedule does not hold up the others
+	RunDueSchedules(now time.Time) error
+}
+
+// The services behind the handlers, set up in main
+var userService UserService
+var taskService TaskService
+var sessionService SessionService
+var unitService UnitService
+var scheduleService ScheduleService
+
+// Implements every service on top of a repository, the files of removed attachments are deleted from blobs
+type service struct {
+	repo  Repository
+	blobs storage.BlobStore
+}
+
+func newService(repo Repository, blobs storage.BlobStore) *service {
+	return &service{repo: repo, blobs: blobs}
+}
+
+// Sets up the handlers to go through the services of s
+func useServices(s *service) {
+	userService = s
+	taskService = s
+	sessionService = s
+	unitService = s
+	scheduleService = s
+}
+
+// Decides whether the actor may act on the tasks and details of the target user, see userAccess
+func (s *service) canAccessUser(actor principal, target string) (bool, error) {
+	return userAccess(s.repo, actor.Id, actor.Type, target)
+}
+
+// Fails unless the task exists and the actor may act on the tasks of its assignee, denied is the reason given otherwise
+func (s *service) checkTaskAccess(actor principal, taskId string, denied string) error {
+	task, err := s.repo.GetTask(taskId)
+	if err != nil {
+		return orNotFound(err, "Task not found")
+	}
+
+	allowed, err := s.canAccessUser(actor, task.AssignedTo)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return forbidden(denied)
+	}
+
+	return nil
+}
+
+// Decides whether the actor may give tasks to the target user, see assigneeAccess
+func (s *service) canAssign(actor principal, target string) (bool, error) {
+	return assigneeAccess(s.repo, actor.Id, actor.Type, target)
+}
+
+//------------------------ SERVICES (User) -----------------------------------------//
+func (s *service) Self(actor principal) (models.User, error) {
+	return s.repo.GetUser(actor.Id)
+}
+
+func (s *service) GetUser(actor principal, id string) (models.User, error) {
+	if actor.Type != "admin" {
+		return models.User{}, forbidden("No admin permissions for this user")
+	}
+
+	// Check if the user falls under the admin user
+	allowed, err := s.canAccessUser(actor, id)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if !allowed {
+		return models.User{}, forbidden("Insufficient admin permissions for this user")
+	}
+
+	user, err := s.repo.GetUser(id)
+	return user, orNotFound(err, "User not found")
+}
+
+func (s *service) ListUsers(actor principal, filter userFilter, page pageRequest) ([]models.User, int, string, error) {
+	if actor.Type != "admin" {
+		return nil, 0, "", forbidden("No admin permissions for this user")
+	}
+
+	if _, ok := userSortColumns[filter.Sort]; !ok {
+		return nil, 0, "", invalidRequest(errors.New("Invalid value for sort"))
+	}
+
+	// Get all the users under the admin user
+	return s.repo.ListUsers(actor.Id, filter, page)
+}
+
+func (s *service) CreateUser(actor principal, req registerUserRequest) (models.User, error) {
+	if actor.Type != "admin" {
+		return models.User{}, forbidden("No admin permissions for this user")
+	}
+
+	// Unlike on registration, the type and unit are taken from the request
+	errs := fieldErrors{}
+	errs.oneOf("type", req.Type, userTypes)
+	errs.required("unit", req.Unit)
+	if err := errs.err(); err != nil {
+		return models.User{}, err
+	}
+
+	// Admins can only add users within their own scope, and other admins only below their own unit
+	allowed, err := userManagement(s.repo, actor.Id, req.Type, req.Unit)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if !allowed {
+		return models.User{}, forbidden("Insufficient admin permissions for this unit")
+	}
+
+	user, passwordhash, err := newUser(req)
+	if err != nil {
+		return user, err
+	}
+
+	return user, s.repo.CreateUser(user, passwordhash)
+}
+
+func (s *service) UpdateUser(actor principal, id string, req updateUserRequest) (models.User, error) {
+	user, err := s.GetUser(actor, id)
+	if err != nil {
+		return user, err
+	}
+
+	// Other users have to be manageable both as they are and as they would be after the update,
+	// so that no admin can edit a peer or make one. Admins may still move themselves within their scope.
+	if user.Id != actor.Id {
+		allowed, err := userManagement(s.repo, actor.Id, user.Utype, user.Unit)
+		if err != nil {
+			return user, err
+		}
+
+		if !allowed {
+			return user, forbidden("Insufficient admin permissions for this user")
+		}
+	}
+
+	if req.Unit != user.Unit || req.Type != user.Utype {
+		var allowed bool
+		if user.Id == actor.Id {
+			allowed, err = s.repo.UnitInScope(actor.Id, req.Unit)
+		} else {
+			allowed, err = userManagement(s.repo, actor.Id, req.Type, req.Unit)
+		}
+		if err != nil {
+			return user, err
+		}
+
+		if !allowed {
+			return user, forbidden("Insufficient admin permissions for this unit")
+		}
+	}
+
+	if req.Active != nil && !*req.Active && user.Id == actor.Id {
+		return user, invalid("Admins cannot deactivate themselves")
+	}
+
+	updated := models.User{
+		Id:        user.Id,
+		Username:  normalizeUsername(req.Username),
+		Utype:     req.Type,
+		Unit:      req.Unit,
+		Man:       req.Man,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Rank:      req.Rank,
+		Active:    user.Active,
+	}
+	if req.Active != nil {
+		updated.Active = *req.Active
+	}
+
+	var passwordhash string
+	if req.Password != "" {
+		passwordhash, err = HashPassword(req.Password)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	if err := s.repo.UpdateUser(updated, passwordhash); err != nil {
+		return user, err
+	}
+
+	return updated, nil
+}
+
+// Users are never removed so that their tasks and history stay intact, they are deactivated instead
+func (s *service) DeactivateUser(actor principal, id string) error {
+	if actor.Type != "admin" {
+		return forbidden("No admin permissions for this user")
+	}
+
+	if id == actor.Id {
+		return invalid("Admins cannot deactivate themselves")
+	}
+
+	user, err := s.GetUser(actor, id)
+	if err != nil {
+		return err
+	}
+
+	allowed, err := userManagement(s.repo, actor.Id, user.Utype, user.Unit)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return forbidden("Insufficient admin permissions for this user")
+	}
+
+	return s.repo.SetUserActive(id, false)
+}
+
+//------------------------ SERVICES (Task) -----------------------------------------//
+func (s *service) GetTask(actor principal, id string) (models.Task, error) {
+	task, err := s.repo.GetTask(id)
+	if err != nil {
+		return task, orNotFound(err, "Task not found")
+	}
+
+	allowed, err := s.canAccessUser(actor, task.AssignedTo)
+	if err != nil {
+		return task, err
+	}
+
+	if !allowed {
+		return task, forbidden("This user doesn't have permissions to view this task")
+	}
+
+	return task, nil
+}
+
+// Normal users only see their own tasks, admins the tasks of the normal users under them
+func (s *service) ListTasks(actor principal, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error) {
+	if actor.Type != "normal" && actor.Type != "admin" {
+		return nil, 0, "", errors.New("Unknown user type")
+	}
+
+	return s.repo.ListTasks(actor.Id, actor.Type, due, filter, page)
+}
+
+func (s *service) ListUserTasks(actor principal, user string, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error) {
+	allowed, err := s.canAccessUser(actor, user)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	if !allowed {
+		return nil, 0, "", forbidden("This user doesn't have permissions to view the tasks of this user")
+	}
+
+	filter.AssignedTo = user
+	return s.ListTasks(actor, due, filter, page)
+}
+
+func (s *service) CreateTask(actor principal, req createTaskRequest) (models.Task, error) {
+	if actor.Type != "admin" {
+		return models.Task{}, forbidden("No admin permissions for this user")
+	}
+
+	if req.Priority == "" {
+		req.Priority = "normal"
+	}
+
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	// Check if admin has enough privileges to assign tasks to this user
+	allowed, err := s.canAssign(actor, req.AssignedTo)
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	if !allowed {
+		return models.Task{}, forbidden("Insufficient admin permissions for this user")
+	}
+
+	// Deactivated users keep their tasks but are not given new ones, the same as in bulk
+	assignee, err := s.repo.GetUser(req.AssignedTo)
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	if !assignee.Active {
+		return models.Task{}, invalid("This user has been deactivated")
+	}
+
+	// Timestamps are always stored in UTC so that they compare correctly in SQL
+	task := models.Task{
+		Id:         shortuuid.New(),
+		Name:       req.Name,
+		AssignedTo: req.AssignedTo,
+		AssignedBy: actor.Id,
+		Status:     "assigned",
+		Priority:   req.Priority,
+		Category:   strings.TrimSpace(req.Category),
+		Tags:       tags,
+		CreatedAt:  time.Now().UTC(),
+		Version:    1,
+	}
+	task.UpdatedAt = task.CreatedAt
+	if req.DueAt != nil {
+		utc := req.DueAt.UTC()
+		task.DueAt = &utc
+	}
+
+	// The task and its history event are written together
+	return task, s.repo.CreateTasks([]models.Task{task})
+}
+
+// Every task is created in a single transaction
+func (s *service) CreateTasks(actor principal, req createTasksRequest) ([]createTasksResult, error) {
+	if actor.Type != "admin" {
+		return nil, forbidden("No admin permissions for this user")
+	}
+
+	if (len(req.AssignedTo) == 0) == (req.Unit == "") {
+		return nil, invalid("Tasks are assigned to either a list of users or a unit")
+	}
+
+	if req.Priority == "" {
+		req.Priority = "normal"
+	}
+
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var dueAt *time.Time
+	if req.DueAt != nil {
+		utc := req.DueAt.UTC()
+		dueAt = &utc
+	}
+
+	results := []createTasksResult{}
+
+	if req.Unit != "" {
+		allowed, err := s.repo.UnitInScope(actor.Id, req.Unit)
+		if err != nil {
+			return nil, err
+		}
+
+		if !allowed {
+			return nil, forbidden("Insufficient admin permissions for this unit")
+		}
+
+		// Every active normal user of the unit and the units below it
+		users, err := s.repo.ListUnitUsers(req.Unit)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			results = append(results, createTasksResult{AssignedTo: user})
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, user := range req.AssignedTo {
+			if seen[user] {
+				continue
+			}
+			seen[user] = true
+
+			result := createTasksResult{AssignedTo: user}
+
+			allowed, err := s.canAssign(actor, user)
+			if err != nil {
+				return nil, err
+			}
+
+			if !allowed {
+				result.Error = "Insufficient admin permissions for this user"
+			} else if details, err := s.repo.GetUser(user); err != nil {
+				return nil, err
+			} else if !details.Active {
+				result.Error = "This user has been deactivated"
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	// The tasks and their history events are written together
+	var tasks []models.Task
+	now := time.Now().UTC()
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+
+		task := models.Task{
+			Id:         shortuuid.New(),
+			Name:       req.Name,
+			AssignedTo: results[i].AssignedTo,
+			AssignedBy: actor.Id,
+			Status:     "assigned",
+			Priority:   req.Priority,
+			Category:   strings.TrimSpace(req.Category),
+			Tags:       tags,
+			CreatedAt:  now,
+			DueAt:      dueAt,
+			Version:    1,
+			UpdatedAt:  now,
+		}
+
+		tasks = append(tasks, task)
+		results[i].Task = task.Id
+	}
+
+	return results, s.repo.CreateTasks(tasks)
+}
+
+// Applies the fields of the update that differ from the task. An update that changes nothing is not written,
+// so that it doesn't move the task to a new version under other clients.
+func (s *service) UpdateTask(actor principal, req updateTaskRequest) (models.Task, error) {
+	// Retrive the task information
+	task, err := s.repo.GetTask(req.Id)
+	if err != nil {
+		return task, orNotFound(err, "Task not found")
+	}
+
+	// Keep the original state for the task history
+	prev := task
+
+	allowed, err := s.canAccessUser(actor, task.AssignedTo)
+	if err != nil {
+		return task, err
+	}
+
+	if !allowed {
+		return task, forbidden("This user doesn't have permissions to update this task")
+	}
+
+	// Clients that send the version they have read only update that version
+	if req.Version != 0 && req.Version != task.Version {
+		return task, preconditionFailed("The task has been changed by someone else, reload it and try again")
+	}
+
+	if req.Tags != nil {
+		req.Tags, err = normalizeTags(req.Tags)
+		if err != nil {
+			return task, err
+		}
+	}
+
+	// Every changed field has to be open to the type of the user
+	changed := changedTaskFields(task, req)
+	if len(changed) == 0 {
+		return task, nil
+	}
+
+	for _, field := range changed {
+		if !canChangeTaskField(actor.Type, field) {
+			return task, forbidden(fmt.Sprintf("This user doesn't have permissions to update the %s of this task", field))
+		}
+	}
+
+	for _, field := range changed {
+		switch field {
+		case "name":
+			task.Name = *req.Name
+		case "assigned_to":
+			// Tasks can only be handed over to normal users the admin has access to
+			allowed, err := s.canAssign(actor, *req.AssignedTo)
+			if err != nil {
+				return task, err
+			}
+
+			if !allowed {
+				return task, forbidden("Insufficient admin permissions for the new assignee")
+			}
+
+			task.AssignedTo = *req.AssignedTo
+		case "due_at":
+			task.DueAt = nil
+			if req.DueAt.Value != nil {
+				utc := req.DueAt.Value.UTC()
+				task.DueAt = &utc
+			}
+		case "priority":
+			task.Priority = *req.Priority
+		case "category":
+			task.Category = strings.TrimSpace(*req.Category)
+		case "tags":
+			task.Tags = req.Tags
+		case "status":
+			// Status changes have to follow the workflow allowed for the role of the user
+			if !canTransition(actor.Type, task.Status, *req.Status) {
+				return task, forbidden(fmt.Sprintf("Cannot move a task from %s to %s", task.Status, *req.Status))
+			}
+
+			var reason string
+			if req.RejectionReason != nil {
+				reason = strings.TrimSpace(*req.RejectionReason)
+			}
+
+			if *req.Status == "rejected" && reason == "" {
+				return task, invalid("A reason is required to reject a task")
+			}
+
+			setTaskStatus(&task, *req.Status, reason, actor.Id)
+		}
+	}
+
+	task.Version = prev.Version + 1
+	task.UpdatedAt = time.Now().UTC()
+
+	// The update and its history event are written together
+	if err := s.repo.UpdateTask(actor.Id, prev, task); err != nil {
+		return task, err
+	}
+
+	// The task is read back for the users it now refers to
+	return s.repo.GetTask(task.Id)
+}
+
+func (s *service) DeleteTask(actor principal, id string) error {
+	if actor.Type != "admin" {
+		return forbidden("No admin permissions for this user")
+	}
+
+	// Retrive the task information
+	task, err := s.repo.GetTask(id)
+	if err != nil {
+		return orNotFound(err, "Task not found")
+	}
+
+	// Check if admin has enough privileges to remove tasks from this user
+	allowed, err := s.canAccessUser(actor, task.AssignedTo)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return forbidden("Insufficient admin permissions for this user")
+	}
+
+	// The task removal and its history event are written together
+	attachments, err := s.repo.DeleteTask(actor.Id, task)
+	if err != nil {
+		return err
+	}
+
+	// The files are only removed once the rows are gone, a failure here only leaves an unreferenced blob
+	for _, attachment := range attachments {
+		if err := s.blobs.Delete(attachment.Id); err != nil {
+			log.Printf("Failed to delete attachment %s: %s", attachment.Id, err)
+		}
+	}
+
+	return nil
+}
+
+//------------------------ SERVICES (Comment) --------------------------------------//
+func (s *service) ListComments(actor principal, task string) ([]models.Comment, error) {
+	if err := s.checkTaskAccess(actor, task, "This user doesn't have permissions to view this task"); err != nil {
+		return nil, err
+	}
+
+	return s.repo.ListComments(task)
+}
+
+func (s *service) CreateComment(actor principal, task string, req createCommentRequest) (models.Comment, error) {
+	if err := s.checkTaskAccess(actor, task, "This user doesn't have permissions to comment on this task"); err != nil {
+		return models.Comment{}, err
+	}
+
+	comment := models.Comment{
+		Id:        shortuuid.New(),
+		TaskId:    task,
+		Author:    actor.Id,
+		Body:      req.Body,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := s.repo.CreateComment(comment); err != nil {
+		return comment, err
+	}
+
+	// Getting the author name
+	author, err := s.repo.GetUser(actor.Id)
+	if err != nil {
+		return comment, err
+	}
+
+	comment.AuthorName = formatUserRef(&models.UserRef{Rank: author.Rank, FirstName: author.FirstName, LastName: author.LastName})
+	return comment, nil
+}
+
+//------------------------ SERVICES (Attachment) -----------------------------------//
+// A file sent to be attached to a task
+type attachmentUpload struct {
+	Filename string
+	Size     int64
+	Content  io.Reader
+}
+
+func (s *service) ListAttachments(actor principal, task string) ([]models.Attachment, error) {
+	if err := s.checkTaskAccess(actor, task, "This user doesn't have permissions to view this task"); err != nil {
+		return nil, err
+	}
+
+	return s.repo.ListAttachments(task)
+}
+
+func (s *service) CreateAttachment(actor principal, task string, read func() (attachmentUpload, error)) (models.Attachment, error) {
+	if err := s.checkTaskAccess(actor, task, "This user doesn't have permissions to add attachments to this task"); err != nil {
+		return models.Attachment{}, err
+	}
+
+	upload, err := read()
+	if err != nil {
+		return models.Attachment{}, err
+	}
+
+	if upload.Size > maxAttachmentSize {
+		return models.Attachment{}, invalid("Attachment is too large")
+	}
+
+	// The type is sniffed from the content, the one sent by the client is not trusted
+	head := make([]byte, 512)
+	n, err := io.ReadFull(upload.Content, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		// The upload has already been received, failing to read it back is not the client's fault
+		return models.Attachment{}, err
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	if !attachmentTypes[contentType] {
+		return models.Attachment{}, invalid("Only images and PDFs can be attached")
+	}
+
+	attachment := models.Attachment{
+		Id:          shortuuid.New(),
+		TaskId:      task,
+		UploadedBy:  actor.Id,
+		Filename:    upload.Filename,
+		ContentType: contentType,
+		Size:        upload.Size,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if err := s.blobs.Put(attachment.Id, io.MultiReader(bytes.NewReader(head), upload.Content)); err != nil {
+		return attachment, err
+	}
+
+	if err := s.repo.CreateAttachment(attachment); err != nil {
+		s.blobs.Delete(attachment.Id)
+		return attachment, err
+	}
+
+	return attachment, nil
+}
+
+func (s *service) GetAttachment(actor principal, task string, id string) (models.Attachment, io.ReadCloser, error) {
+	if err := s.checkTaskAccess(actor, task, "This user doesn't have permissions to view this task"); err != nil {
+		return models.Attachment{}, nil, err
+	}
+
+	// The attachment has to belong to the task that was checked
+	attachment, err := s.repo.GetAttachment(task, id)
+	if err != nil {
+		return attachment, nil, orNotFound(err, "Attachment not found")
+	}
+
+	blob, err := s.blobs.Get(attachment.Id)
+	return attachment, blob, err
+}
+
+//------------------------ SERVICES (History) --------------------------------------//
+func (s *service) TaskHistory(actor principal, task string) ([]models.TaskEvent, error) {
+	events, err := s.repo.ListTaskEvents(task)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) == 0 {
+		return nil, notFound("Task not found")
+	}
+
+	// The assignee of the latest event decides who can see the history, which still works once the task is deleted
+	allowed, err := s.canAccessUser(actor, events[len(events)-1].AssignedTo)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allowed {
+		return nil, forbidden("This user doesn't have permissions to view this task")
+	}
+
+	return events, nil
+}
+
+func (s *service) AuditFeed(actor principal, limit int) ([]models.TaskEvent, error) {
+	if actor.Type != "admin" {
+		return nil, forbidden("No admin permissions for this user")
+	}
+
+	// Get the latest events for the tasks of every user under the admin user
+	return s.repo.ListAuditEvents(actor.Id, limit)
+}
+
+//------------------------ SERVICES (Session) --------------------------------------//
+// Creates the access token and the refresh token of a session, the session is stored by the caller
+func newSession(uid string, utype string, now time.Time) (loginUserResponse, session, error) {
+	var response loginUserResponse
+
+	expiresAt := now.Add(accessTokenTTL)
+	token, err := createJWT(uid, utype, JWT_SECRET, expiresAt)
+	if err != nil {
+		return response, session{}, err
+	}
+
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return response, session{}, err
+	}
+
+	response.Jwt = token
+	response.ExpiresAt = expiresAt
+	response.RefreshToken = refresh
+	response.Type = utype
+	response.Id = uid
+
+	return response, session{TokenHash: hashToken(refresh), User: uid, CreatedAt: now, ExpiresAt: now.Add(refreshTokenTTL)}, nil
+}
+
+// Starts a new session with an access token and a refresh token
+func (s *service) startSession(uid string, utype string) (loginUserResponse, error) {
+	response, session, err := newSession(uid, utype, time.Now().UTC())
+	if err != nil {
+		return response, err
+	}
+
+	return response, s.repo.CreateSession(session)
+}
+
+func (s *service) Login(req loginUserRequest) (loginUserResponse, error) {
+	// Get the user associated to the username if it exists, usernames are matched case insensitively
+	user, err := s.repo.GetCredentials(normalizeUsername(req.Username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return loginUserResponse{}, notFound("User not found")
+	} else if err != nil {
+		return loginUserResponse{}, err
+	}
+
+	if !CheckPasswordHash(req.Password, user.PasswordHash) {
+		return loginUserResponse{}, newError(http.StatusUnauthorized, codeInvalidCredentials, "Incorrect password")
+	}
+
+	if !user.Active {
+		return loginUserResponse{}, forbidden("Account is deactivated")
+	}
+
+	return s.startSession(user.Id, user.Utype)
+}
+
+func (s *service) Register(req registerUserRequest) (loginUserResponse, error) {
+	invite, err := s.repo.GetInvite(req.Invite)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && invite.UsedBy != "") {
+		return loginUserResponse{}, forbidden("Invalid or used invite")
+	} else if err != nil {
+		return loginUserResponse{}, err
+	}
+
+	now := time.Now().UTC()
+	if now.After(invite.ExpiresAt) {
+		return loginUserResponse{}, forbidden("Invite has expired")
+	}
+
+	// The type and unit always come from the invite
+	req.Type = invite.Type
+	req.Unit = invite.Unit
+
+	user, passwordhash, err := newUser(req)
+	if err != nil {
+		return loginUserResponse{}, err
+	}
+
+	if err := s.repo.RegisterUser(invite.Code, user, passwordhash, now); err != nil {
+		return loginUserResponse{}, err
+	}
+
+	return s.startSession(user.Id, user.Utype)
+}
+
+func (s *service) Refresh(refreshToken string) (loginUserResponse, error) {
+	tokenHash := hashToken(refreshToken)
+
+	current, err := s.repo.GetSession(tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return loginUserResponse{}, newError(http.StatusUnauthorized, codeInvalidToken, "Invalid refresh token")
+	} else if err != nil {
+		return loginUserResponse{}, err
+	}
+
+	now := time.Now().UTC()
+
+	// A revoked token being used again means it has leaked, so every session of the user is ended
+	if current.RevokedAt != nil {
+		if err := s.repo.RevokeUserSessions(current.User, now); err != nil {
+			return loginUserResponse{}, err
+		}
+
+		return loginUserResponse{}, newError(http.StatusUnauthorized, codeInvalidToken, "Refresh token has been revoked")
+	}
+
+	if now.After(current.ExpiresAt) {
+		return loginUserResponse{}, newError(http.StatusUnauthorized, codeInvalidToken, "Refresh token has expired")
+	}
+
+	// The type is read again so that role changes apply from the next refresh onwards
+	user, err := s.repo.GetUser(current.User)
+	if err != nil {
+		return loginUserResponse{}, err
+	}
+
+	if !user.Active {
+		return loginUserResponse{}, forbidden("Account is deactivated")
+	}
+
+	response, next, err := newSession(user.Id, user.Utype, now)
+	if err != nil {
+		return response, err
+	}
+
+	return response, s.repo.RotateSession(tokenHash, next, now)
+}
+
+// The access token runs out on its own shortly after
+func (s *service) Logout(refreshToken string) error {
+	return s.repo.RevokeSession(hashToken(refreshToken), time.Now().UTC())
+}
+
+//------------------------ SERVICES (Unit) -----------------------------------------//
+// Checks that a unit of the given level can be placed directly below the parent unit
+func (s *service) checkUnitParent(level string, parent string) error {
+	parentUnit, err := s.repo.GetUnit(parent)
+	if err != nil {
+		return orInvalid(err, "Unknown parent unit")
+	}
+
+	for i := 1; i < len(unitLevels); i++ {
+		if unitLevels[i] == level {
+			if unitLevels[i-1] != parentUnit.Level {
+				return invalid(fmt.Sprintf("A %s can only be placed below a %s", level, unitLevels[i-1]))
+			}
+			return nil
+		}
+	}
+
+	return invalid("Invalid unit level")
+}
+
+func (s *service) ListUnits(actor principal) ([]models.Unit, error) {
+	if actor.Type != "admin" {
+		return nil, forbidden("No admin permissions for this user")
+	}
+
+	// Get all the units under the admin user
+	return s.repo.ListUnits(actor.Id)
+}
+
+func (s *service) CreateUnit(actor principal, req unitRequest) (models.Unit, error) {
+	if actor.Type != "admin" {
+		return models.Unit{}, forbidden("No admin permissions for this user")
+	}
+
+	// New units always go below a unit the admin has access to
+	allowed, err := s.repo.UnitInScope(actor.Id, req.Parent)
+	if err != nil {
+		return models.Unit{}, err
+	}
+
+	if !allowed {
+		return models.Unit{}, forbidden("Insufficient admin permissions for this unit")
+	}
+
+	if err := s.checkUnitParent(req.Level, req.Parent); err != nil {
+		return models.Unit{}, err
+	}
+
+	unit := models.Unit{
+		Id:     shortuuid.New(),
+		Name:   req.Name,
+		Level:  req.Level,
+		Parent: req.Parent,
+	}
+
+	return unit, s.repo.CreateUnit(unit)
+}
+
+// Renames a unit or moves it, along with everything below it, to a different parent
+func (s *service) UpdateUnit(actor principal, id string, req unitRequest) (models.Unit, error) {
+	if actor.Type != "admin" {
+		return models.Unit{}, forbidden("No admin permissions for this user")
+	}
+
+	unit, err := s.repo.GetUnit(id)
+	if err != nil {
+		return unit, orNotFound(err, "Unit not found")
+	}
+
+	// Both the unit and its new parent have to be within the scope of the admin
+	allowed, err := s.repo.UnitInScope(actor.Id, unit.Id)
+	if err != nil {
+		return unit, err
+	}
+
+	if allowed && req.Parent != unit.Parent {
+		allowed, err = s.repo.UnitInScope(actor.Id, req.Parent)
+		if err != nil {
+			return unit, err
+		}
+
+		// The level check also makes it impossible to move a unit below itself
+		if err := s.checkUnitParent(unit.Level, req.Parent); err != nil {
+			return unit, err
+		}
+	}
+
+	if !allowed {
+		return unit, forbidden("Insufficient admin permissions for this unit")
+	}
+
+	unit.Name = req.Name
+	unit.Parent = req.Parent
+
+	return unit, s.repo.UpdateUnit(unit)
+}
+
+//------------------------ SERVICES (Invite) ---------------------------------------//
+func (s *service) ListInvites(actor principal) ([]models.Invite, error) {
+	if actor.Type != "admin" {
+		return nil, forbidden("No admin permissions for this user")
+	}
+
+	// Get all the invites for the units under the admin user
+	return s.repo.ListInvites(actor.Id)
+}
+
+func (s *service) CreateInvite(actor principal, req createInviteRequest) (models.Invite, error) {
+	if actor.Type != "admin" {
+		return models.Invite{}, forbidden("No admin permissions for this user")
+	}
+
+	if req.ExpiresIn == 0 {
+		req.ExpiresIn = 7
+	}
+
+	// Admins can only invite users into their own scope, and other admins only below their own unit
+	allowed, err := userManagement(s.repo, actor.Id, req.Type, req.Unit)
+	if err != nil {
+		return models.Invite{}, err
+	}
+
+	if !allowed {
+		return models.Invite{}, forbidden("Insufficient admin permissions for this unit")
+	}
+
+	now := time.Now().UTC()
+	invite := models.Invite{
+		Code:      shortuuid.New(),
+		Type:      req.Type,
+		Unit:      req.Unit,
+		CreatedBy: actor.Id,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, req.ExpiresIn),
+	}
+
+	return invite, s.repo.CreateInvite(invite)
+}
+
+// Revokes an invite which has not been used yet
+func (s *service) DeleteInvite(actor principal, code string) error {
+	if actor.Type != "admin" {
+		return forbidden("No admin permissions for this user")
+	}
+
+	// Used invites are kept as the record of who registered with them
+	invite, err := s.repo.GetInvite(code)
+	if err != nil {
+		return orNotFound(err, "Invite not found")
+	}
+
+	if invite.UsedBy != "" {
+		return notFound("Invite not found")
+	}
+
+	allowed, err := s.repo.UnitInScope(actor.Id, invite.Unit)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return forbidden("Insufficient admin permissions for this unit")
+	}
+
+	return s.repo.DeleteInvite(code)
+}
+
+//------------------------ SERVICES (Template) -------------------------------------//
+func (s *service) ListTemplates(actor principal) ([]models.Template, error) {
+	if actor.Type != "admin" {
+		return nil, forbidden("No admin permissions for this user")
+	}
+
+	// Get all the templates of the units under the admin user
+	return s.repo.ListTemplates(actor.Id)
+}
+
+// Templates belong to the unit of the admin creating them
+func (s *service) CreateTemplate(actor principal, req createTemplateRequest) (models.Template, error) {
+	if actor.Type != "admin" {
+		return models.Template{}, forbidden("No admin permissions for this user")
+	}
+
+	admin, err := s.repo.GetUser(actor.Id)
+	if err != nil {
+		return models.Template{}, err
+	}
+
+	template := models.Template{
+		Id:        shortuuid.New(),
+		Name:      req.Name,
+		DueInDays: req.DueInDays,
+		Unit:      admin.Unit,
+		CreatedBy: actor.Id,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	return template, s.repo.CreateTemplate(template)
+}
+
+func (s *service) DeleteTemplate(actor principal, id string) error {
+	if actor.Type != "admin" {
+		return forbidden("No admin permissions for this user")
+	}
+
+	template, err := s.repo.GetTemplate(id)
+	if err != nil {
+		return orNotFound(err, "Template not found")
+	}
+
+	allowed, err := s.repo.UnitInScope(actor.Id, template.Unit)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return forbidden("Insufficient admin permissions for this template")
+	}
+
+	return s.repo.DeleteTemplate(id)
+}
+
+//------------------------ SERVICES (Schedule) -------------------------------------//
+func (s *service) ListSchedules(actor principal) ([]models.Schedule, error) {
+	if actor.Type != "admin" {
+		return nil, forbidden("No admin permissions for this user")
+	}
+
+	// Get all the schedules using templates of the units under the admin user
+	return s.repo.ListSchedules(actor.Id)
+}
+
+// A schedule targets either a single user or every normal user within a unit
+func (s *service) CreateSchedule(actor principal, req createScheduleRequest) (models.Schedule, error) {
+	if actor.Type != "admin" {
+		return models.Schedule{}, forbidden("No admin permissions for this user")
+	}
+
+	if (req.AssignedTo == "") == (req.Unit == "") {
+		return models.Schedule{}, invalid("A schedule targets either a user or a unit")
+	}
+
+	rule, err := cron.Parse(req.Rule)
+	if err != nil {
+		return models.Schedule{}, invalidRequest(err)
+	}
+
+	now := time.Now()
+	nextRun := rule.Next(now.In(scheduleLocation))
+	if nextRun.IsZero() {
+		return models.Schedule{}, invalid("This schedule never runs")
+	}
+
+	template, err := s.repo.GetTemplate(req.Template)
+	if err != nil {
+		return models.Schedule{}, orInvalid(err, "Unknown template")
+	}
+
+	// Both the template and the target have to be within the scope of the admin
+	allowed, err := s.repo.UnitInScope(actor.Id, template.Unit)
+	if err == nil && allowed && req.AssignedTo != "" {
+		allowed, err = s.canAssign(actor, req.AssignedTo)
+	} else if err == nil && allowed {
+		allowed, err = s.repo.UnitInScope(actor.Id, req.Unit)
+	}
+
+	if err != nil {
+		return models.Schedule{}, err
+	}
+
+	if !allowed {
+		return models.Schedule{}, forbidden("Insufficient admin permissions for this schedule")
+	}
+
+	schedule := models.Schedule{
+		Id:         shortuuid.New(),
+		Template:   req.Template,
+		Rule:       req.Rule,
+		AssignedTo: req.AssignedTo,
+		Unit:       req.Unit,
+		CreatedBy:  actor.Id,
+		CreatedAt:  now.UTC(),
+		NextRun:    nextRun.UTC(),
+		Active:     true,
+	}
+
+	return schedule, s.repo.CreateSchedule(schedule)
+}
+
+// Stops a schedule, it is kept so that its past runs can still be traced
+func (s *service) StopSchedule(actor principal, id string) error {
+	if actor.Type != "admin" {
+		return forbidden("No admin permissions for this user")
+	}
+
+	schedule, err := s.repo.GetSchedule(id)
+	if err != nil {
+		return orNotFound(err, "Schedule not found")
+	}
+
+	template, err := s.repo.GetTemplate(schedule.Template)
+	if err != nil {
+		return orNotFound(err, "Schedule not found")
+	}
+
+	allowed, err := s.repo.UnitInScope(actor.Id, template.Unit)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return forbidden("Insufficient admin permissions for this schedule")
+	}
+
+	return s.repo.StopSchedule(id)
+}
+
+func (s *service) RunDueSchedules(now time.Time) error {
+	schedules, err := s.repo.ListDueSchedules(now)
+	if err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		if err := s.runSchedule(schedule, now); err != nil {
+			log.Printf("Failed to run task schedule %s: %s", schedule.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// Creates the tasks for a single due run of a schedule and moves it on to its next run.
+// When the server was down for several runs, only a single set of tasks is created.
+func (s *service) runSchedule(schedule models.Schedule, now time.Time) error {
+	rule, err := cron.Parse(schedule.Rule)
+	if err != nil {
+		return err
+	}
+
+	tasks, err := s.scheduleTasks(schedule, now)
+	if err != nil {
+		return err
+	}
+
+	after := now
+	if schedule.NextRun.After(after) {
+		after = schedule.NextRun
+	}
+
+	nextRun := rule.Next(after.In(scheduleLocation)).UTC()
+
+	return s.repo.RunSchedule(schedule, tasks, nextRun, now)
+}
+
+// Builds a task from the template for every active target of the schedule that the creator still has access to
+func (s *service) scheduleTasks(schedule models.Schedule, now time.Time) ([]models.Task, error) {
+	// Deactivated admins no longer assign tasks, their schedules resume once they are reactivated
+	creator, err := s.repo.GetUser(schedule.CreatedBy)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !creator.Active) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	template, err := s.repo.GetTemplate(schedule.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	if schedule.AssignedTo != "" {
+		targets = []string{schedule.AssignedTo}
+	} else if targets, err = s.repo.ListUnitUsers(schedule.Unit); err != nil {
+		return nil, err
+	}
+
+	var tasks []models.Task
+	for _, target := range targets {
+		user, err := s.repo.GetUser(target)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		allowed, err := s.repo.UserInScope(schedule.CreatedBy, user.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		if !allowed || !user.Active {
+			continue
+		}
+
+		task := models.Task{
+			Id:         shortuuid.New(),
+			Name:       template.Name,
+			AssignedTo: user.Id,
+			AssignedBy: schedule.CreatedBy,
+			Status:     "assigned",
+			Priority:   "normal",
+			CreatedAt:  now,
+		}
+		if template.DueInDays > 0 {
+			dueAt := schedule.NextRun.AddDate(0, 0, template.DueInDays)
+			task.DueAt = &dueAt
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+//------------------------ RULES ---------------------------------------------------//
+func createJWT(uid string, utype string, secret string, expiresAt time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":   uid,
+		"type": utype,
+		"iat":  time.Now().Unix(),
+		"exp":  expiresAt.Unix(),
+		"jti":  shortuuid.New(),
+	})
+	tokenString, err := token.SignedString([]byte(secret))
+
+	return tokenString, err
+}
+
+// Only a hash of the refresh token is stored, so a leaked database cannot be used to resume sessions
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// Builds a new active user from a request, along with the hash of its password
+func newUser(req registerUserRequest) (models.User, string, error) {
+	user := models.User{
+		Id:        shortuuid.New(),
+		Username:  normalizeUsername(req.Username),
+		Utype:     req.Type,
+		Unit:      req.Unit,
+		Man:       req.Man,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Rank:      req.Rank,
+		Active:    true,
+	}
+
+	// Generate the password hash
+	passwordhash, err := HashPassword(req.Password)
+
+	return user, passwordhash, err
+}
+
+// Usernames are stored trimmed and lower case so that they can be logged in with in any case
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Decides whether a user may act on the tasks and details of the target user. Normal users only have access to themselves, admins to everyone within their unit subtree
+func userAccess(users UserRepository, uid string, utype string, target string) (bool, error) {
+	if utype == "normal" {
+		return uid == target, nil
+	}
+
+	if utype != "admin" {
+		return false, nil
+	}
+
+	return users.UserInScope(uid, target)
+}
+
+// Tasks are only assigned to normal users the admin has access to, the task listings leave out everyone else
+func assigneeAccess(users UserRepository, uid string, utype string, target string) (bool, error) {
+	allowed, err := userAccess(users, uid, utype, target)
+	if err != nil || !allowed {
+		return allowed, err
+	}
+
+	user, err := users.GetUser(target)
+	if err != nil {
+		return false, err
+	}
+
+	return user.Utype == "normal", nil
+}
+
+// Decides whether an admin may create, edit or deactivate a user of the given type in the unit. Normal users can
+// be managed anywhere within the admin's unit subtree, admins only in the units strictly below the admin's own
+// so that no admin can take over a peer or one of the admins above them.
+func userManagement(users UserRepository, uid string, utype string, unit string) (bool, error) {
+	allowed, err := users.UnitInScope(uid, unit)
+	if err != nil || !allowed || utype != "admin" {
+		return allowed, err
+	}
+
+	admin, err := users.GetUser(uid)
+	if err != nil {
+		return false, err
+	}
+
+	return admin.Unit != unit, nil
+}
+
+var taskPriorities = []string{"low", "normal", "high", "critical"}
+
+func validPriority(priority string) bool {
+	for _, p := range taskPriorities {
+		if p == priority {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tags are compared case insensitively, so they are trimmed, lower cased and deduplicated
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || strings.Contains(tag, ",") {
+			return nil, invalid("Tags cannot be empty or contain commas")
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// The types of users allowed to change each field of a task on an update. Admins also need both the current
+// and the new assignee within their scope, assignees can only ever update their own tasks. The status is further
+// limited by taskTransitions, and the verifier and the timestamps are never set directly but follow the status.
+var taskFieldRoles = map[string][]string{
+	"name":        {"admin"},
+	"assigned_to": {"admin"},
+	"due_at":      {"admin"},
+	"priority":    {"admin"},
+	"category":    {"admin"},
+	"tags":        {"admin"},
+	"status":      {"admin", "normal"},
+}
+
+func canChangeTaskField(utype string, field string) bool {
+	for _, role := range taskFieldRoles[field] {
+		if role == utype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lists the fields of taskFieldRoles that an update changes, the tags of the update have to be normalized already.
+// Fields left out of the update are kept as they are.
+func changedTaskFields(task models.Task, req updateTaskRequest) []string {
+	var changed []string
+
+	if req.Name != nil && *req.Name != task.Name {
+		changed = append(changed, "name")
+	}
+
+	if req.AssignedTo != nil && *req.AssignedTo != task.AssignedTo {
+		changed = append(changed, "assigned_to")
+	}
+
+	if req.DueAt.Set && !sameTime(req.DueAt.Value, task.DueAt) {
+		changed = append(changed, "due_at")
+	}
+
+	if req.Priority != nil && *req.Priority != task.Priority {
+		changed = append(changed, "priority")
+	}
+
+	if req.Category != nil && strings.TrimSpace(*req.Category) != task.Category {
+		changed = append(changed, "category")
+	}
+
+	if req.Tags != nil && strings.Join(req.Tags, ",") != strings.Join(task.Tags, ",") {
+		changed = append(changed, "tags")
+	}
+
+	if req.Status != nil && *req.Status != task.Status {
+		changed = append(changed, "status")
+	}
+
+	return changed
+}
+
+// Two optional times are the same when both are missing or both are set to the same instant
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+// The status workflow of a task, listing the moves each type of user is allowed to make:
+// assigned → in_progress → submitted → verified | rejected → in_progress.
+// Assignees work on and submit tasks, admins verify or reject what has been submitted.
+var taskTransitions = map[string]map[string][]string{
+	"normal": {
+		"assigned":    {"in_progress"},
+		"in_progress": {"submitted"},
+		"rejected":    {"in_progress"},
+	},
+	"admin": {
+		"submitted": {"verified", "rejected"},
+	},
+}
+
+func canTransition(utype string, from string, to string) bool {
+	for _, status := range taskTransitions[utype][from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Moves a task to a new status and keeps the fields that depend on it in step
+func setTaskStatus(task *models.Task, status string, reason string, uid string) {
+	now := time.Now().UTC()
+
+	switch status {
+	case "in_progress":
+		// The reason of a rejection stays in the history once the task is reworked
+		task.SubmittedAt = nil
+		task.RejectionReason = ""
+	case "submitted":
+		task.SubmittedAt = &now
+		task.RejectionReason = ""
+		task.VerifiedBy = ""
+		task.VerifiedAt = nil
+	case "verified":
+		task.VerifiedBy = uid
+		task.VerifiedAt = &now
+		task.RejectionReason = ""
+	case "rejected":
+		task.RejectionReason = reason
+	}
+
+	task.Status = status
+}
+
+// Flattens the tracked fields of a task so that two versions of it can be compared
+func taskFields(task *models.Task) map[string]interface{} {
+	if task == nil {
+		return map[string]interface{}{}
+	}
+
+	var dueAt interface{}
+	if task.DueAt != nil {
+		dueAt = task.DueAt.UTC().Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"name":             task.Name,
+		"assigned_to":      task.AssignedTo,
+		"assigned_by":      task.AssignedBy,
+		"status":           task.Status,
+		"rejection_reason": task.RejectionReason,
+		"verified_by":      task.VerifiedBy,
+		"priority":         task.Priority,
+		"category":         task.Category,
+		"tags":             strings.Join(task.Tags, ","),
+		"due_at":           dueAt,
+	}
+}
+
+// Lists every field that differs between the two versions, a nil task stands for a missing one
+func diffTasks(before *models.Task, after *models.Task) map[string]models.FieldChange {
+	changes := map[string]models.FieldChange{}
+
+	from, to := taskFields(before), taskFields(after)
+	for field := range from {
+		if _, ok := to[field]; !ok {
+			to[field] = nil
+		}
+	}
+
+	for field, value := range to {
+		if from[field] != value {
+			changes[field] = models.FieldChange{From: from[field], To: value}
+		}
+	}
+
+	return changes
+}
+
+// The bcrypt cost of new password hashes, hashing takes about a second at this cost
+var passwordCost = 14
+
+func HashPassword(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(bytes), err
+}
+
+func CheckPasswordHash(password, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+//------------------------ DATA ACCESS (Session) -----------------------------------//
+func (s *sqlRepository) CreateSession(session session) error {
+	sql := `INSERT INTO refresh_token (refresh_token, "user", created_at, expires_at) VALUES (?, ?, ?, ?)`
+	_, err := s.db.Exec(sql, session.TokenHash, session.User, session.CreatedAt, session.ExpiresAt)
+	return err
+}
+
+func (s *sqlRepository) GetSession(tokenHash string) (session, error) {
+	current := session{TokenHash: tokenHash}
+
+	sql := `SELECT "user", created_at, expires_at, revoked_at FROM refresh_token WHERE refresh_token = ?`
+	err := s.db.QueryRow(sql, tokenHash).Scan(&current.User, &current.CreatedAt, &current.ExpiresAt, &current.RevokedAt)
+
+	return current, err
+}
+
+// Revoking the current token and storing the next one happen together, so that a token can only be rotated once
+func (s *sqlRepository) RotateSession(tokenHash string, next session, revokedAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	sql := `UPDATE refresh_token SET revoked_at = ? WHERE refresh_token = ? AND revoked_at IS NULL`
+	result, err := tx.Exec(sql, revokedAt, tokenHash)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return newError(http.StatusUnauthorized, codeInvalidToken, "Refresh token has been revoked")
+	}
+
+	sql = `INSERT INTO refresh_token (refresh_token, "user", created_at, expires_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(sql, next.TokenHash, next.User, next.CreatedAt, next.ExpiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlRepository) RevokeSession(tokenHash string, revokedAt time.Time) error {
+	sql := `UPDATE refresh_token SET revoked_at = ? WHERE refresh_token = ? AND revoked_at IS NULL`
+	_, err := s.db.Exec(sql, revokedAt, tokenHash)
+	return err
+}
+
+func (s *sqlRepository) RevokeUserSessions(user string, revokedAt time.Time) error {
+	sql := `UPDATE refresh_token SET revoked_at = ? WHERE "user" = ? AND revoked_at IS NULL`
+	_, err := s.db.Exec(sql, revokedAt, user)
+	return err
+}
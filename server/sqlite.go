@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+//------------------------ SQLITE --------------------------------------------------//
+// Task names and comment bodies are searched through FTS5 tables, the server has to be built with -tags sqlite_fts5
+var sqliteDialect = dialect{
+	Name: "sqlite",
+	GroupConcat: func(column string) string {
+		return "GROUP_CONCAT(" + column + ")"
+	},
+	AddTaskSearch: func(sql *string, args *[]interface{}, search string) {
+		match := fts5Query(search)
+		*sql += ` AND task.task IN (SELECT task FROM task_search WHERE task_search MATCH ?
+		UNION SELECT task FROM task_comment_search WHERE task_comment_search MATCH ?)`
+		*args = append(*args, match, match)
+	},
+}
+
+// Turns free text into an FTS5 query matching every word as a prefix, quoting keeps the FTS5 syntax out of it
+func fts5Query(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.Replace(word, `"`, `""`, -1)+`"*`)
+	}
+
+	return strings.Join(terms, " ")
+}
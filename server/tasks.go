@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lithammer/shortuuid"
+
+	"server/models"
+)
+
+//------------------------ DATA ACCESS (Task) --------------------------------------//
+// Every task is read with its assignee, assigner and verifier in a single query, the joins name the task table task
+func (s *sqlRepository) taskColumns() string {
+	return `task.task, task.name, task.assigned_to, task.assigned_by, task.status, task.rejection_reason, task.verified_by,
+	task.priority, task.category, ` + s.taskTagsColumn() + `, task.created_at, task.due_at, task.submitted_at, task.verified_at,
+	task.version, task.updated_at,
+	assignee."user", assignee.rank, assignee.first_name, assignee.last_name,
+	assigner."user", assigner.rank, assigner.first_name, assigner.last_name,
+	verifier."user", verifier.rank, verifier.first_name, verifier.last_name`
+}
+
+const taskJoins = ` LEFT JOIN "user" AS assignee ON assignee."user" = task.assigned_to
+	LEFT JOIN "user" AS assigner ON assigner."user" = task.assigned_by
+	LEFT JOIN "user" AS verifier ON verifier."user" = task.verified_by`
+
+// Lists the labels of a task as a single comma separated column
+func (s *sqlRepository) taskTagsColumn() string {
+	return `COALESCE((SELECT ` + s.dialect.GroupConcat("task_tag.tag") + ` FROM task_tag WHERE task_tag.task = task.task), '')`
+}
+
+// Implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Reads a row selected with taskColumns, followed by any extra columns of the query
+func scanTask(row rowScanner, extra ...interface{}) (models.Task, error) {
+	var task models.Task
+	var tags string
+	var assignee, assigner, verifier [4]sql.NullString
+
+	dest := []interface{}{&task.Id, &task.Name, &task.AssignedTo, &task.AssignedBy, &task.Status, &task.RejectionReason, &task.VerifiedBy,
+		&task.Priority, &task.Category, &tags, &task.CreatedAt, &task.DueAt, &task.SubmittedAt, &task.VerifiedAt,
+		&task.Version, &task.UpdatedAt,
+		&assignee[0], &assignee[1], &assignee[2], &assignee[3],
+		&assigner[0], &assigner[1], &assigner[2], &assigner[3], &verifier[0], &verifier[1], &verifier[2], &verifier[3]}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return task, err
+	}
+
+	task.Tags = splitTags(tags)
+	task.Assignee = userRef(assignee)
+	task.Assigner = userRef(assigner)
+	task.Verifier = userRef(verifier)
+
+	return task, nil
+}
+
+// A missing user, such as the verifier of a task that has not been verified, is nil
+func userRef(columns [4]sql.NullString) *models.UserRef {
+	if !columns[0].Valid {
+		return nil
+	}
+
+	return &models.UserRef{
+		Id:        columns[0].String,
+		Rank:      columns[1].String,
+		FirstName: columns[2].String,
+		LastName:  columns[3].String,
+	}
+}
+
+func (s *sqlRepository) GetTask(id string) (models.Task, error) {
+	sql := `SELECT ` + s.taskColumns() + ` FROM task` + taskJoins + ` WHERE task.task = ?`
+	return scanTask(s.db.QueryRow(sql, id))
+}
+
+// Normal users only see their own tasks, admins the tasks of the normal users under them
+func (s *sqlRepository) ListTasks(uid string, utype string, due dueFilter, filter taskFilter, page pageRequest) ([]models.Task, int, string, error) {
+	tasks := []models.Task{}
+
+	from := ` FROM task`
+	var where string
+	var args []interface{}
+	if utype == "admin" {
+		from += ` INNER JOIN "user" ON "user"."user" = task.assigned_to`
+		where = ` WHERE "user".type = 'normal' AND `
+		addScopeFilter(&where, &args, uid)
+	} else {
+		where = ` WHERE task.assigned_to = ?`
+		args = append(args, uid)
+	}
+
+	addDueFilters(&where, &args, due)
+	addTaskFilters(&where, &args, filter)
+
+	if filter.Search != "" {
+		s.dialect.AddTaskSearch(&where, &args, filter.Search)
+	}
+
+	q := listQuery{
+		Columns:    s.taskColumns(),
+		From:       from,
+		Joins:      taskJoins,
+		Where:      where,
+		Args:       args,
+		SortKey:    taskSortColumns[filter.Sort],
+		IdColumn:   "task.task",
+		Descending: filter.Descending,
+	}
+
+	p, err := s.listPage(q, page, func(rows *sql.Rows) (string, string, error) {
+		var key string
+		task, err := scanTask(rows, &key)
+		tasks = append(tasks, task)
+		return key, task.Id, err
+	})
+
+	return tasks, p.Total, p.Next, err
+}
+
+func (s *sqlRepository) CreateTasks(tasks []models.Task) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, task := range tasks {
+		if err := insertTask(tx, task); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Only updates the task while it is still at the version of before, so that concurrent updates can't overwrite each other
+func (s *sqlRepository) UpdateTask(actor string, before models.Task, after models.Task) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	sql := `UPDATE task SET name = ?, assigned_to = ?, assigned_by = ?, status = ?, rejection_reason = ?, verified_by = ?,
+	priority = ?, category = ?, due_at = ?, submitted_at = ?, verified_at = ?, version = ?, updated_at = ? WHERE task = ? AND version = ?`
+	result, err := tx.Exec(sql, after.Name, after.AssignedTo, after.AssignedBy, after.Status, after.RejectionReason, after.VerifiedBy,
+		after.Priority, after.Category, after.DueAt, after.SubmittedAt, after.VerifiedAt, after.Version, after.UpdatedAt, after.Id, before.Version)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return preconditionFailed("The task has been changed by someone else, reload it and try again")
+	}
+
+	if err := setTaskTags(tx, after.Id, after.Tags); err != nil {
+		return err
+	}
+
+	if err := recordTaskEvent(tx, actor, "update", &before, &after); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The rows referring to the task go first, foreign keys are enforced on PostgreSQL
+func (s *sqlRepository) DeleteTask(actor string, task models.Task) ([]models.Attachment, error) {
+	attachments, err := s.ListAttachments(task.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	for _, sql := range []string{
+		`DELETE FROM task_tag WHERE task = ?`,
+		`DELETE FROM task_comment WHERE task = ?`,
+		`DELETE FROM task_attachment WHERE task = ?`,
+		`DELETE FROM task WHERE task = ?`,
+	} {
+		if _, err := tx.Exec(sql, task.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := recordTaskEvent(tx, actor, "delete", &task, nil); err != nil {
+		return nil, err
+	}
+
+	return attachments, tx.Commit()
+}
+
+func (s *sqlRepository) ListComments(taskId string) ([]models.Comment, error) {
+	var comments []models.Comment
+
+	sql := `SELECT task_comment.task_comment, task_comment.task, task_comment.author, "user".rank, "user".first_name, "user".last_name,
+	task_comment.body, task_comment.created_at
+	FROM task_comment INNER JOIN "user" ON "user"."user" = task_comment.author
+	WHERE task_comment.task = ? ORDER BY task_comment.created_at`
+
+	results, err := s.db.Query(sql, taskId)
+	if err != nil {
+		return comments, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var comment models.Comment
+		var author models.UserRef
+		if err := results.Scan(&comment.Id, &comment.TaskId, &comment.Author, &author.Rank, &author.FirstName, &author.LastName, &comment.Body, &comment.CreatedAt); err != nil {
+			return comments, err
+		}
+
+		comment.AuthorName = formatUserRef(&author)
+		comments = append(comments, comment)
+	}
+
+	return comments, results.Err()
+}
+
+func (s *sqlRepository) CreateComment(comment models.Comment) error {
+	sql := `INSERT INTO task_comment (task_comment, task, author, body, created_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(sql, comment.Id, comment.TaskId, comment.Author, comment.Body, comment.CreatedAt)
+	return err
+}
+
+func (s *sqlRepository) ListAttachments(taskId string) ([]models.Attachment, error) {
+	var attachments []models.Attachment
+
+	sql := `SELECT task_attachment, task, uploaded_by, filename, content_type, size, created_at FROM task_attachment WHERE task = ? ORDER BY created_at`
+	results, err := s.db.Query(sql, taskId)
+	if err != nil {
+		return attachments, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var attachment models.Attachment
+		if err := results.Scan(&attachment.Id, &attachment.TaskId, &attachment.UploadedBy, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.CreatedAt); err != nil {
+			return attachments, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, results.Err()
+}
+
+func (s *sqlRepository) GetAttachment(taskId string, id string) (models.Attachment, error) {
+	var attachment models.Attachment
+
+	sql := `SELECT task_attachment, task, uploaded_by, filename, content_type, size, created_at FROM task_attachment WHERE task_attachment = ? AND task = ?`
+	err := s.db.QueryRow(sql, id, taskId).Scan(&attachment.Id, &attachment.TaskId, &attachment.UploadedBy, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.CreatedAt)
+
+	return attachment, err
+}
+
+func (s *sqlRepository) CreateAttachment(attachment models.Attachment) error {
+	sql := `INSERT INTO task_attachment (task_attachment, task, uploaded_by, filename, content_type, size, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(sql, attachment.Id, attachment.TaskId, attachment.UploadedBy, attachment.Filename, attachment.ContentType, attachment.Size, attachment.CreatedAt)
+	return err
+}
+
+func (s *sqlRepository) ListTaskEvents(taskId string) ([]models.TaskEvent, error) {
+	sql := `SELECT task_event, task, assigned_to, actor, action, changes, created_at FROM task_event WHERE task = ? ORDER BY created_at`
+	return s.queryTaskEvents(sql, taskId)
+}
+
+func (s *sqlRepository) ListAuditEvents(admin string, limit int) ([]models.TaskEvent, error) {
+	sql := `SELECT task_event.task_event, task_event.task, task_event.assigned_to, task_event.actor, task_event.action,
+	task_event.changes, task_event.created_at
+	FROM task_event INNER JOIN "user" ON "user"."user" = task_event.assigned_to
+	WHERE "user".type = 'normal' AND `
+	args := []interface{}{}
+	addScopeFilter(&sql, &args, admin)
+	sql += " ORDER BY task_event.created_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	return s.queryTaskEvents(sql, args...)
+}
+
+// Reads the events selected by the query, whose changes are kept as JSON
+func (s *sqlRepository) queryTaskEvents(sql string, args ...interface{}) ([]models.TaskEvent, error) {
+	var events []models.TaskEvent
+
+	results, err := s.db.Query(sql, args...)
+	if err != nil {
+		return events, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var event models.TaskEvent
+		var changes string
+		if err := results.Scan(&event.Id, &event.TaskId, &event.AssignedTo, &event.Actor, &event.Action, &changes, &event.CreatedAt); err != nil {
+			return events, err
+		}
+
+		if err := json.Unmarshal([]byte(changes), &event.Changes); err != nil {
+			return events, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, results.Err()
+}
+
+// Creates a new task at its first version along with the first event of its history
+func insertTask(tx *sql.Tx, task models.Task) error {
+	sql := `INSERT INTO task (task, name, assigned_to, assigned_by, status, verified_by, priority, category, created_at, due_at, version, updated_at)
+	VALUES (?, ?, ?, ?, ?, '', ?, ?, ?, ?, 1, ?)`
+	_, err := tx.Exec(sql, task.Id, task.Name, task.AssignedTo, task.AssignedBy, task.Status, task.Priority, task.Category, task.CreatedAt, task.DueAt, task.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := setTaskTags(tx, task.Id, task.Tags); err != nil {
+		return err
+	}
+
+	return recordTaskEvent(tx, task.AssignedBy, "create", nil, &task)
+}
+
+// Replaces every tag of a task
+func setTaskTags(tx *sql.Tx, taskId string, tags []string) error {
+	if _, err := tx.Exec(`DELETE FROM task_tag WHERE task = ?`, taskId); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if _, err := tx.Exec(`INSERT INTO task_tag (task, tag) VALUES (?, ?)`, taskId, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Only tasks which have not been submitted yet can be overdue or coming due
+func addDueFilters(sql *string, args *[]interface{}, filter dueFilter) {
+	now := time.Now().UTC()
+
+	if filter.Overdue {
+		*sql += " AND task.status IN ('assigned', 'in_progress', 'rejected') AND task.due_at < ?"
+		*args = append(*args, now)
+	} else if filter.DueWithin > 0 {
+		*sql += " AND task.status IN ('assigned', 'in_progress', 'rejected') AND task.due_at >= ? AND task.due_at <= ?"
+		*args = append(*args, now, now.AddDate(0, 0, filter.DueWithin))
+	}
+}
+
+// Tasks have to carry every one of the requested tags, the search is left to the dialect of the database
+func addTaskFilters(sql *string, args *[]interface{}, filter taskFilter) {
+	if filter.AssignedTo != "" {
+		*sql += " AND task.assigned_to = ?"
+		*args = append(*args, filter.AssignedTo)
+	}
+
+	if len(filter.Priorities) > 0 {
+		*sql += " AND task.priority IN (?" + strings.Repeat(", ?", len(filter.Priorities)-1) + ")"
+		for _, p := range filter.Priorities {
+			*args = append(*args, p)
+		}
+	}
+
+	if filter.Category != "" {
+		*sql += " AND LOWER(task.category) = ?"
+		*args = append(*args, strings.ToLower(filter.Category))
+	}
+
+	for _, tag := range filter.Tags {
+		*sql += " AND EXISTS (SELECT 1 FROM task_tag WHERE task_tag.task = task.task AND task_tag.tag = ?)"
+		*args = append(*args, tag)
+	}
+}
+
+// Appends an event to the history of a task, updates that change nothing are not recorded
+func recordTaskEvent(tx *sql.Tx, actor string, action string, before *models.Task, after *models.Task) error {
+	changes := diffTasks(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// The latest known state gives the task and its assignee
+	current := after
+	if current == nil {
+		current = before
+	}
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	sql := `INSERT INTO task_event (task_event, task, assigned_to, actor, action, changes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(sql, shortuuid.New(), current.Id, current.AssignedTo, actor, action, string(data), time.Now().UTC())
+
+	return err
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+
+	split := strings.Split(tags, ",")
+	sort.Strings(split)
+	return split
+}
+
+// Columns a task listing can be sorted on, priorities are ranked from low to critical.
+// Every key is text so that it can be carried in a page cursor, tasks without a due date come last.
+var taskSortColumns = map[string]string{
+	"priority":   "CASE task.priority WHEN 'low' THEN '0' WHEN 'normal' THEN '1' WHEN 'high' THEN '2' ELSE '3' END",
+	"category":   "task.category",
+	"name":       "task.name",
+	"created_at": "CAST(task.created_at AS TEXT)",
+	"due_at":     "COALESCE(CAST(task.due_at AS TEXT), '9999')",
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"time"
+
+	"server/models"
+)
+
+//------------------------ DATA ACCESS (Unit) --------------------------------------//
+func (s *sqlRepository) GetUnit(id string) (models.Unit, error) {
+	var unit models.Unit
+
+	sql := `SELECT unit, name, level, COALESCE(parent, '') FROM unit WHERE unit = ?`
+	err := s.db.QueryRow(sql, id).Scan(&unit.Id, &unit.Name, &unit.Level, &unit.Parent)
+
+	return unit, err
+}
+
+func (s *sqlRepository) ListUnits(admin string) ([]models.Unit, error) {
+	var units []models.Unit
+
+	sql := adminScopeCTE + ` SELECT unit.unit, unit.name, unit.level, COALESCE(unit.parent, '')
+	FROM unit INNER JOIN scope ON scope.unit = unit.unit ORDER BY unit.unit`
+
+	results, err := s.db.Query(sql, admin)
+	if err != nil {
+		return units, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var unit models.Unit
+		if err := results.Scan(&unit.Id, &unit.Name, &unit.Level, &unit.Parent); err != nil {
+			return units, err
+		}
+		units = append(units, unit)
+	}
+
+	return units, results.Err()
+}
+
+func (s *sqlRepository) CreateUnit(unit models.Unit) error {
+	sql := `INSERT INTO unit (unit, name, level, parent) VALUES (?, ?, ?, NULLIF(?, ''))`
+	_, err := s.db.Exec(sql, unit.Id, unit.Name, unit.Level, unit.Parent)
+	return err
+}
+
+func (s *sqlRepository) UpdateUnit(unit models.Unit) error {
+	sql := `UPDATE unit SET name = ?, parent = NULLIF(?, '') WHERE unit = ?`
+	_, err := s.db.Exec(sql, unit.Name, unit.Parent, unit.Id)
+	return err
+}
+
+//------------------------ DATA ACCESS (Invite) ------------------------------------//
+const inviteColumns = `invite.invite, invite.type, invite.unit, invite.created_by, invite.created_at, invite.expires_at,
+	COALESCE(invite.used_by, ''), invite.used_at`
+
+func scanInvite(row rowScanner) (models.Invite, error) {
+	var invite models.Invite
+	err := row.Scan(&invite.Code, &invite.Type, &invite.Unit, &invite.CreatedBy, &invite.CreatedAt, &invite.ExpiresAt, &invite.UsedBy, &invite.UsedAt)
+	return invite, err
+}
+
+func (s *sqlRepository) ListInvites(admin string) ([]models.Invite, error) {
+	var invites []models.Invite
+
+	sql := adminScopeCTE + ` SELECT ` + inviteColumns + `
+	FROM invite INNER JOIN scope ON scope.unit = invite.unit ORDER BY invite.created_at DESC`
+
+	results, err := s.db.Query(sql, admin)
+	if err != nil {
+		return invites, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		invite, err := scanInvite(results)
+		if err != nil {
+			return invites, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, results.Err()
+}
+
+func (s *sqlRepository) GetInvite(code string) (models.Invite, error) {
+	sql := `SELECT ` + inviteColumns + ` FROM invite WHERE invite.invite = ?`
+	return scanInvite(s.db.QueryRow(sql, code))
+}
+
+func (s *sqlRepository) CreateInvite(invite models.Invite) error {
+	sql := `INSERT INTO invite (invite, type, unit, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(sql, invite.Code, invite.Type, invite.Unit, invite.CreatedBy, invite.CreatedAt, invite.ExpiresAt)
+	return err
+}
+
+func (s *sqlRepository) DeleteInvite(code string) error {
+	sql := `DELETE FROM invite WHERE invite = ? AND used_by IS NULL`
+	_, err := s.db.Exec(sql, code)
+	return err
+}
+
+func (s *sqlRepository) RegisterUser(code string, user models.User, passwordHash string, usedAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := insertUser(tx, user, passwordHash); err != nil {
+		return err
+	}
+
+	sql := `UPDATE invite SET used_by = ?, used_at = ? WHERE invite = ? AND used_by IS NULL`
+	result, err := tx.Exec(sql, user.Id, usedAt, code)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return forbidden("Invalid or used invite")
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"server/models"
+)
+
+//------------------------ DATA ACCESS (User) --------------------------------------//
+const userColumns = `"user"."user", "user".username, "user".type, "user".first_name, "user".last_name, "user".rank, "user".unit, "user".man, "user".active`
+
+// Columns a user listing can be sorted on
+var userSortColumns = map[string]string{
+	"username": `"user".username`,
+	"name":     `"user".last_name || ' ' || "user".first_name`,
+	"rank":     `"user".rank`,
+	"unit":     `"user".unit`,
+}
+
+// Reads a row selected with userColumns, followed by any extra columns of the query
+func scanUser(row rowScanner, extra ...interface{}) (models.User, error) {
+	var user models.User
+	dest := []interface{}{&user.Id, &user.Username, &user.Utype, &user.FirstName, &user.LastName, &user.Rank, &user.Unit, &user.Man, &user.Active}
+	err := row.Scan(append(dest, extra...)...)
+	return user, err
+}
+
+func (s *sqlRepository) GetUser(id string) (models.User, error) {
+	sql := `SELECT ` + userColumns + ` FROM "user" WHERE "user"."user" = ?`
+	return scanUser(s.db.QueryRow(sql, id))
+}
+
+func (s *sqlRepository) GetCredentials(username string) (userCredentials, error) {
+	var passwordHash string
+
+	sql := `SELECT ` + userColumns + `, "user".password_hash FROM "user" WHERE LOWER("user".username) = ?`
+	user, err := scanUser(s.db.QueryRow(sql, username), &passwordHash)
+	return userCredentials{User: user, PasswordHash: passwordHash}, err
+}
+
+func (s *sqlRepository) ListUsers(admin string, filter userFilter, page pageRequest) ([]models.User, int, string, error) {
+	users := []models.User{}
+
+	where := ` WHERE "user".type = 'normal' AND `
+	var args []interface{}
+	addScopeFilter(&where, &args, admin)
+
+	// Deactivated users are left out unless they are asked for
+	if !filter.IncludeInactive {
+		where += ` AND "user".active = TRUE`
+	}
+
+	if filter.Search != "" {
+		like := "%" + strings.ToLower(filter.Search) + "%"
+		where += ` AND (LOWER("user".username) LIKE ? OR LOWER("user".first_name) LIKE ? OR LOWER("user".last_name) LIKE ?)`
+		args = append(args, like, like, like)
+	}
+
+	q := listQuery{
+		Columns:    userColumns,
+		From:       ` FROM "user"`,
+		Where:      where,
+		Args:       args,
+		SortKey:    userSortColumns[filter.Sort],
+		IdColumn:   `"user"."user"`,
+		Descending: filter.Descending,
+	}
+
+	p, err := s.listPage(q, page, func(rows *sql.Rows) (string, string, error) {
+		var key string
+		user, err := scanUser(rows, &key)
+		users = append(users, user)
+		return key, user.Id, err
+	})
+
+	return users, p.Total, p.Next, err
+}
+
+func (s *sqlRepository) ListUnitUsers(unit string) ([]string, error) {
+	var users []string
+
+	sql := `WITH RECURSIVE target(unit) AS (
+		SELECT CAST(? AS TEXT)
+		UNION ALL
+		SELECT unit.unit FROM unit INNER JOIN target ON unit.parent = target.unit
+	)
+	SELECT "user" FROM "user" WHERE type = 'normal' AND active = TRUE AND unit IN (SELECT unit FROM target)`
+
+	results, err := s.db.Query(sql, unit)
+	if err != nil {
+		return users, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var user string
+		if err := results.Scan(&user); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	return users, results.Err()
+}
+
+func (s *sqlRepository) CreateUser(user models.User, passwordHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := insertUser(tx, user, passwordHash); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlRepository) UpdateUser(user models.User, passwordHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// A missing user is reported as sql.ErrNoRows
+	var id string
+	sql := `SELECT "user" FROM "user" WHERE "user" = ?`
+	if err := tx.QueryRow(sql, user.Id).Scan(&id); err != nil {
+		return err
+	}
+
+	if err := checkUsernameFree(tx, user.Username, user.Id); err != nil {
+		return err
+	}
+
+	sql = `UPDATE "user" SET username = ?, type = ?, unit = ?, man = ?, rank = ?, first_name = ?, last_name = ?, active = ? WHERE "user" = ?`
+	args := []interface{}{user.Username, user.Utype, user.Unit, user.Man, user.Rank, user.FirstName, user.LastName, user.Active, user.Id}
+
+	if passwordHash != "" {
+		sql = `UPDATE "user" SET username = ?, type = ?, unit = ?, man = ?, rank = ?, first_name = ?, last_name = ?, active = ?, password_hash = ? WHERE "user" = ?`
+		args = []interface{}{user.Username, user.Utype, user.Unit, user.Man, user.Rank, user.FirstName, user.LastName, user.Active, passwordHash, user.Id}
+	}
+
+	if _, err := tx.Exec(sql, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlRepository) SetUserActive(id string, active bool) error {
+	sql := `UPDATE "user" SET active = ? WHERE "user" = ?`
+	_, err := s.db.Exec(sql, active, id)
+	return err
+}
+
+func (s *sqlRepository) UserInScope(admin string, user string) (bool, error) {
+	var count int
+	sql := adminScopeCTE + ` SELECT COUNT(*) FROM "user" WHERE "user"."user" = ? AND "user".unit IN (SELECT unit FROM scope)`
+	if err := s.db.QueryRow(sql, admin, user).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *sqlRepository) UnitInScope(admin string, unit string) (bool, error) {
+	var count int
+	sql := adminScopeCTE + ` SELECT COUNT(*) FROM scope WHERE unit = ?`
+	if err := s.db.QueryRow(sql, admin, unit).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Creates a new user, the username has to be normalized already
+func insertUser(tx *sql.Tx, user models.User, passwordHash string) error {
+	if err := checkUsernameFree(tx, user.Username, user.Id); err != nil {
+		return err
+	}
+
+	sql := `INSERT INTO "user" ("user", username, password_hash, type, unit, man, rank, first_name, last_name, active) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(sql, user.Id, user.Username, passwordHash, user.Utype, user.Unit, user.Man, user.Rank, user.FirstName, user.LastName, user.Active)
+
+	return err
+}
+
+// Fails with a conflict when another user than uid already has the username, which has to be normalized
+func checkUsernameFree(tx *sql.Tx, username string, uid string) error {
+	var count int
+
+	sql := `SELECT COUNT(*) FROM "user" WHERE LOWER(username) = ? AND "user" != ?`
+	if err := tx.QueryRow(sql, username, uid).Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return newError(http.StatusConflict, codeConflict, "This username is already taken")
+	}
+
+	return nil
+}
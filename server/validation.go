@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+//------------------------ VALIDATION ----------------------------------------------//
+// JSON bodies are never expected to be larger than this, attachments are uploaded separately
+const maxBodyBytes = 1 << 20
+
+var userTypes = []string{"normal", "admin"}
+
+var taskStatuses = []string{"assigned", "in_progress", "submitted", "verified", "rejected"}
+
+// Ranks of the armed forces, officers and military experts included
+var validRanks = []string{
+	"REC", "PTE", "LCP", "CPL", "CFC",
+	"3SG", "2SG", "1SG", "SSG", "MSG",
+	"3WO", "2WO", "1WO", "MWO", "SWO", "CWO",
+	"2LT", "LTA", "CPT", "MAJ", "LTC", "SLTC", "COL", "BG", "MG", "LG",
+	"ME1", "ME2", "ME3", "ME4", "ME5", "ME6", "ME7", "ME8",
+}
+
+// Implemented by request bodies that check their own fields once decoded
+type validator interface {
+	validate() error
+}
+
+// Decodes a JSON body into v and validates it. Bodies that are too large, hold fields v doesn't know
+// or more than a single value are rejected before any of it is used.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		return invalidRequest(errors.New("The request body has to be a single JSON object"))
+	}
+
+	if v, ok := v.(validator); ok {
+		return v.validate()
+	}
+
+	return nil
+}
+
+func decodeError(err error) error {
+	message := err.Error()
+
+	switch {
+	case message == "http: request body too large":
+		return newError(http.StatusRequestEntityTooLarge, codeInvalidRequest, fmt.Sprintf("The request body cannot be larger than %d bytes", maxBodyBytes))
+	case strings.HasPrefix(message, "json: unknown field "):
+		return &apiError{
+			Status:  http.StatusBadRequest,
+			Code:    codeInvalidRequest,
+			Message: "Unknown field in the request body",
+			Details: map[string]string{"field": strings.Trim(strings.TrimPrefix(message, "json: unknown field "), `"`)},
+		}
+	}
+
+	return invalidRequest(err)
+}
+
+// Collects a message for every invalid field, so that a client learns about all of them at once
+type fieldErrors map[string]string
+
+func (e fieldErrors) check(ok bool, field string, message string) {
+	if _, found := e[field]; !ok && !found {
+		e[field] = message
+	}
+}
+
+func (e fieldErrors) required(field string, value string) {
+	e.check(strings.TrimSpace(value) != "", field, "is required")
+}
+
+func (e fieldErrors) maxLength(field string, value string, max int) {
+	e.check(utf8.RuneCountInString(value) <= max, field, fmt.Sprintf("cannot be longer than %d characters", max))
+}
+
+func (e fieldErrors) length(field string, value string, min int, max int) {
+	n := utf8.RuneCountInString(value)
+	e.check(n >= min && n <= max, field, fmt.Sprintf("has to be between %d and %d characters", min, max))
+}
+
+func (e fieldErrors) oneOf(field string, value string, allowed []string) {
+	for _, a := range allowed {
+		if a == value {
+			return
+		}
+	}
+
+	e.check(false, field, "has to be one of "+strings.Join(allowed, ", "))
+}
+
+func (e fieldErrors) tags(field string, tags []string) {
+	e.check(len(tags) <= 20, field, "cannot hold more than 20 tags")
+	for _, tag := range tags {
+		e.maxLength(field, tag, 32)
+	}
+}
+
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return &apiError{Status: http.StatusUnprocessableEntity, Code: codeValidationFailed, Message: "Some fields are invalid", Details: map[string]string(e)}
+}
+
+// Usernames are logged in with, so they cannot hold any whitespace
+func (e fieldErrors) username(field string, value string) {
+	e.length(field, value, 3, 32)
+	e.check(!strings.ContainsAny(value, " \t\r\n"), field, "cannot contain whitespace")
+}
+
+// Bcrypt only looks at the first 72 bytes of a password
+func (e fieldErrors) password(field string, value string) {
+	e.length(field, value, 8, 72)
+	e.check(len(value) <= 72, field, "cannot be longer than 72 bytes")
+}
+
+func (e fieldErrors) profile(firstName string, lastName string, rank string, man int) {
+	e.required("first_name", firstName)
+	e.maxLength("first_name", firstName, 64)
+	e.required("last_name", lastName)
+	e.maxLength("last_name", lastName, 64)
+	e.oneOf("rank", rank, validRanks)
+	e.check(man >= -1, "man", "cannot be below -1")
+}
+
+func (req loginUserRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("username", req.Username)
+	errs.required("password", req.Password)
+	return errs.err()
+}
+
+func (req refreshTokenRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("refresh_token", req.RefreshToken)
+	return errs.err()
+}
+
+// The type and unit are only checked when an admin creates the user, registration takes them from the invite
+func (req registerUserRequest) validate() error {
+	errs := fieldErrors{}
+	errs.username("username", req.Username)
+	errs.password("password", req.Password)
+	errs.profile(req.FirstName, req.LastName, req.Rank, req.Man)
+	if req.Type != "" {
+		errs.oneOf("type", req.Type, userTypes)
+	}
+	return errs.err()
+}
+
+// The password is only changed when one is given
+func (req updateUserRequest) validate() error {
+	errs := fieldErrors{}
+	errs.username("username", req.Username)
+	if req.Password != "" {
+		errs.password("password", req.Password)
+	}
+	errs.oneOf("type", req.Type, userTypes)
+	errs.required("unit", req.Unit)
+	errs.profile(req.FirstName, req.LastName, req.Rank, req.Man)
+	return errs.err()
+}
+
+func (req createInviteRequest) validate() error {
+	errs := fieldErrors{}
+	errs.oneOf("type", req.Type, userTypes)
+	errs.required("unit", req.Unit)
+	errs.check(req.ExpiresIn == 0 || (req.ExpiresIn >= 1 && req.ExpiresIn <= 30), "expires_in_days", "has to be between 1 and 30")
+	return errs.err()
+}
+
+func (req unitRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("name", req.Name)
+	errs.maxLength("name", req.Name, 64)
+	errs.oneOf("level", req.Level, unitLevels)
+	return errs.err()
+}
+
+func (req createTaskRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("name", req.Name)
+	errs.maxLength("name", req.Name, 200)
+	errs.required("assigned_to", req.AssignedTo)
+	if req.Priority != "" {
+		errs.oneOf("priority", req.Priority, taskPriorities)
+	}
+	errs.maxLength("category", req.Category, 64)
+	errs.tags("tags", req.Tags)
+	return errs.err()
+}
+
+func (req createTasksRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("name", req.Name)
+	errs.maxLength("name", req.Name, 200)
+	errs.check(len(req.AssignedTo) <= 500, "assigned_to", "cannot hold more than 500 users")
+	if req.Priority != "" {
+		errs.oneOf("priority", req.Priority, taskPriorities)
+	}
+	errs.maxLength("category", req.Category, 64)
+	errs.tags("tags", req.Tags)
+	return errs.err()
+}
+
+func (req deleteTaskRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	return errs.err()
+}
+
+// Updates only check the fields they hold. Read only fields are refused outright, unlike a field that is
+// invalid, they can never be corrected by the client.
+func (req updateTaskRequest) validate() error {
+	if readOnly := req.readOnlyTaskFields.sent(); len(readOnly) > 0 {
+		details := map[string]string{}
+		for _, field := range readOnly {
+			details[field] = "is read only"
+		}
+		return &apiError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "Some fields of a task cannot be updated", Details: details}
+	}
+
+	errs := fieldErrors{}
+	if req.Name != nil {
+		errs.required("name", *req.Name)
+		errs.maxLength("name", *req.Name, 200)
+	}
+	if req.AssignedTo != nil {
+		errs.required("assigned_to", *req.AssignedTo)
+	}
+	if req.Status != nil {
+		errs.oneOf("status", *req.Status, taskStatuses)
+	}
+	if req.RejectionReason != nil {
+		errs.maxLength("rejection_reason", *req.RejectionReason, 1000)
+	}
+	if req.Priority != nil {
+		errs.oneOf("priority", *req.Priority, taskPriorities)
+	}
+	if req.Category != nil {
+		errs.maxLength("category", *req.Category, 64)
+	}
+	errs.tags("tags", req.Tags)
+	errs.check(req.Version >= 0, "version", "cannot be negative")
+	return errs.err()
+}
+
+// Replacing a task takes the fields every task has, the others are kept when they are left out
+func (req updateTaskRequest) validateReplacement() error {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.check(req.Name != nil, "name", "is required")
+	errs.check(req.AssignedTo != nil, "assigned_to", "is required")
+	errs.check(req.Status != nil, "status", "is required")
+	return errs.err()
+}
+
+func (f readOnlyTaskFields) sent() []string {
+	var sent []string
+	for _, field := range []struct {
+		name  string
+		value []byte
+	}{
+		{"assigned_by", f.AssignedBy},
+		{"verified_by", f.VerifiedBy},
+		{"created_at", f.CreatedAt},
+		{"submitted_at", f.SubmittedAt},
+		{"verified_at", f.VerifiedAt},
+		{"updated_at", f.UpdatedAt},
+		{"assignee", f.Assignee},
+		{"assigner", f.Assigner},
+		{"verifier", f.Verifier},
+	} {
+		if field.value != nil {
+			sent = append(sent, field.name)
+		}
+	}
+
+	return sent
+}
+
+func (req createCommentRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("body", req.Body)
+	errs.maxLength("body", req.Body, 4000)
+	return errs.err()
+}
+
+func (req createTemplateRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("name", req.Name)
+	errs.maxLength("name", req.Name, 200)
+	errs.check(req.DueInDays >= 0 && req.DueInDays <= 365, "due_in_days", "has to be between 0 and 365")
+	return errs.err()
+}
+
+func (req createScheduleRequest) validate() error {
+	errs := fieldErrors{}
+	errs.required("template", req.Template)
+	errs.required("rule", req.Rule)
+	errs.maxLength("rule", req.Rule, 100)
+	return errs.err()
+}